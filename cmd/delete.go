@@ -25,14 +25,15 @@ import (
 
 // deleteCmd represents the delete command
 var deleteCmd = &cobra.Command{
-	Use:   "delete <context>",
+	Use:   "delete <context|label>",
 	Args:  cobra.ExactArgs(1),
-	Short: "Deletes the local kubernetes configuration for the supplied context name.",
+	Short: "Deletes the local kubernetes configuration for the supplied context name or source label.",
 	Long: `Deletes the local kubernetes configuration for the supplied context name.
+Given the label of a source instead, all the contexts merged from it are deleted.
 Optionally if the '-p/-persistent' flag is supplied and a matching configuration can be found in the config file it is deleted also.
 
-Matching with the config file label is done by extracting the label from the context name assuming the following format for it:
-{{ initial_context_name }}@{{ label }}
+Contexts are matched with the config file labels through the owner khg records in the "khg" extension of the
+contexts it merges.
 `,
 	Run: deleteCtx,
 }
@@ -55,27 +56,69 @@ func deleteCtx(cmd *cobra.Command, args []string) {
 		log.Fatalf("unable to get 'persistent' flag value")
 	}
 
+	destKonfig, err := kubeconfig.DestInit(configUsed.Destination)
+	if err != nil {
+		log.Fatalf("unable to initialize destination file %q: %v", configUsed.Destination, err)
+	}
+	err = destKonfig.AdoptLegacy(configUsed.Sources)
+	if err != nil {
+		log.Fatalf("unable to record the owner of entries merged by older versions: %v", err)
+	}
+	contexts, sourceLabel := deleteTargets(destKonfig, configUsed.Sources, label)
+	if len(contexts) == 0 && sourceLabel == "" {
+		log.Fatalf("no context or source named: %q", label)
+	}
+
 	if persistent {
-		log.Infof("deleting label: %q from persistent config file", label)
-		err = cfg.Delete(&configUsed, label)
-		if err != nil {
-			log.Errorf("unable to delete label: %q from persistent config: %v. continuing", label, err)
-		}
-		err = cfg.Save(&configUsed)
-		if err != nil {
-			log.Fatalf("unable to save persistent config: %s, %v", viper.ConfigFileUsed(), err)
+		if sourceLabel == "" {
+			log.Errorf("unable to delete label: %q from persistent config: no source found. continuing", label)
+		} else {
+			log.Infof("deleting label: %q from persistent config file", sourceLabel)
+			err = cfg.Delete(&configUsed, sourceLabel)
+			if err != nil {
+				log.Errorf("unable to delete label: %q from persistent config: %v. continuing", sourceLabel, err)
+			}
+			err = cfg.Save(&configUsed)
+			if err != nil {
+				log.Fatalf("unable to save persistent config: %s, %v", viper.ConfigFileUsed(), err)
+			}
 		}
 	}
 
-	destKonfig, err := kubeconfig.DestInit(configUsed.Destination)
-	if err != nil {
-		log.Fatalf("unable to initialize destination file %q: %v", configUsed.Destination, err)
+	if len(contexts) == 0 {
+		log.Warnf("no contexts of source %q found in the kubernetes config file", label)
+		return
 	}
-	log.Infof("deleting label: %q from kubernetes config file", label)
-	err = destKonfig.Delete(label)
+	log.Infof("deleting contexts: %q from kubernetes config file", contexts)
+	err = destKonfig.Delete(contexts...)
 	if err != nil {
 		log.Fatalf("unable to delete label: %q from: %q: %v", label, destKonfig.Url, err)
 	}
 	log.Infof("succesfuly deleted: %q", label)
 
 }
+
+// deleteTargets returns the contexts to delete and the label of the source they come from.
+// The name is a context name, or the label of a source to delete all of its contexts.
+func deleteTargets(dest *kubeconfig.KubeConfig, sources map[string]cfg.Source, name string) ([]string, string) {
+	if _, ok := dest.Config.Contexts[name]; ok {
+		owner, ok := dest.ContextOwner(name)
+		if !ok {
+			return []string{name}, ""
+		}
+		if owner.Group != "" {
+			log.Warnf("context %q comes from source %q, which stands for many sources. it is kept", name, owner.Group)
+			return []string{name}, ""
+		}
+		if _, ok := sources[owner.Label]; !ok {
+			return []string{name}, ""
+		}
+		return []string{name}, owner.Label
+	}
+
+	src, ok := sources[name]
+	if !ok {
+		return nil, ""
+	}
+	return dest.OwnedContexts(name, kubeconfig.IsExpanding(src)), name
+}
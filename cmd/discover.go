@@ -0,0 +1,128 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/kubeconfig"
+	"net/url"
+)
+
+// discoverCmd represents the discover command
+var discoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Discovers clusters and adds them as one source.",
+	Long: `Discovers clusters and adds them as one source. The source is expanded again on every gather,
+so new clusters are added and the contexts of removed ones are reported.
+Updating the configuration file is controlled by the 'persistent' global flag.`,
+}
+
+// discoverCapiCmd represents the discover capi command
+var discoverCapiCmd = &cobra.Command{
+	Use:   "capi",
+	Short: "Discovers the workload clusters of a Cluster API management cluster.",
+	Long: `Discovers the workload clusters of a Cluster API management cluster.
+Every Cluster with a kubeconfig secret (<cluster>-kubeconfig) is merged into the destination.
+The management cluster is reached with a context from the destination (or --kubeconfig).
+
+The label of each cluster is rendered from --label-template, default: {{.Label}}-{{.Match}}
+where .Label is the source label and .Match is <namespace>-<name>. .Namespace and .Name can be used as well.
+`,
+	Args: cobra.NoArgs,
+	Run:  discoverCapi,
+}
+
+func init() {
+	rootCmd.AddCommand(discoverCmd)
+	discoverCmd.AddCommand(discoverCapiCmd)
+
+	discoverCapiCmd.Flags().StringP("context", "c", "", "Context of the management cluster. Default: the current context")
+	discoverCapiCmd.Flags().StringP("namespace", "n", "", "Only discover clusters in this namespace. Default: all namespaces")
+	discoverCapiCmd.Flags().StringP("label", "l", "", "Label for the source. Default: the context name")
+	discoverCapiCmd.Flags().String("label-template", "", "Template for the label of each cluster.")
+	discoverCapiCmd.Flags().String("kubeconfig", "", "Kube configuration with the management cluster context. Default: the destination")
+	discoverCapiCmd.Flags().BoolP("insecure", "i", false, "Will remove the CA from the clusters and add the 'insecure-skip-tls-verify' flag.")
+}
+
+func discoverCapi(cmd *cobra.Command, args []string) {
+	configUsed := cfg.Cfg{}
+	err := viper.Unmarshal(&configUsed)
+	if err != nil {
+		log.Fatalf("unable to Unmarshal config file: %v", err)
+	}
+
+	context, err := cmd.Flags().GetString("context")
+	if err != nil {
+		log.Fatalf("unable get context from command line: %v", err)
+	}
+	namespace, err := cmd.Flags().GetString("namespace")
+	if err != nil {
+		log.Fatalf("unable get namespace from command line: %v", err)
+	}
+	label, err := cmd.Flags().GetString("label")
+	if err != nil {
+		log.Fatalf("unable get label from command line: %v", err)
+	}
+
+	src := cfg.Source{}
+	src.LabelTemplate, err = cmd.Flags().GetString("label-template")
+	if err != nil {
+		log.Fatalf("unable get label-template from command line: %v", err)
+	}
+	src.Kubeconfig, err = cmd.Flags().GetString("kubeconfig")
+	if err != nil {
+		log.Fatalf("unable get kubeconfig from command line: %v", err)
+	}
+	src.Insecure, err = cmd.Flags().GetBool("insecure")
+	if err != nil {
+		log.Fatalf("unable get insecure from command line: %v", err)
+	}
+
+	u := url.URL{Scheme: "capi", Path: "/" + namespace}
+	if context != "" {
+		u.RawQuery = url.Values{"context": []string{context}}.Encode()
+	}
+	src.Source = u.String()
+	if label == "" {
+		label = context
+	}
+	if label == "" {
+		label = "capi"
+	}
+
+	destKonfig, err := kubeconfig.DestInit(configUsed.Destination)
+	if err != nil {
+		log.Fatalf("unable to initialize destination file %s: %v", configUsed.Destination, err)
+	}
+	err = mergeExpanded(destKonfig, label, src)
+	if err != nil {
+		log.Fatalf("unable to discover clusters: %v", err)
+	}
+
+	persistent, err := rootCmd.Flags().GetBool("persistent")
+	if err != nil {
+		log.Fatalf("unable get persistent flag: %v", err)
+	}
+	if persistent {
+		err := cfg.Add(&configUsed, label, src)
+		if err != nil {
+			log.Fatalf("unable to save config file: %v", err)
+		}
+	}
+}
@@ -51,6 +51,18 @@ func gather(cmd *cobra.Command, args []string) {
 	khg := cfg.Cfg{}
 	viper.Unmarshal(&khg)
 
+	// an invalid rule would leave the destination half merged
+	for _, label := range sourceLabels(khg.Sources) {
+		rules, err := kubeconfig.Rules(khg.Sources[label])
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = kubeconfig.CheckRules(rules)
+		if err != nil {
+			log.Fatalf("invalid source: %v: %v", label, err)
+		}
+	}
+
 	dest, err := kubeconfig.DestInit(khg.Destination)
 	if err != nil {
 		log.Fatalf("unable to parse destination url: %v: %v", khg.Destination, err)
@@ -60,21 +72,35 @@ func gather(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalf("unable to parse destination config file: %v: %v", khg.Destination, err)
 	}
+	err = dest.AdoptLegacy(khg.Sources)
+	if err != nil {
+		log.Fatalf("unable to record the owner of entries merged by older versions: %v", err)
+	}
 
 	konfigs := make([]*kubeconfig.KubeConfig, 0)
-	for label, src := range khg.Sources {
-		k, err := kubeconfig.DestInit(src.Source)
+	// sources are merged in the order of their labels, so conflicts are resolved the same way every time
+	for _, label := range sourceLabels(khg.Sources) {
+		src := khg.Sources[label]
+		if kubeconfig.IsStdin(src.Source) {
+			log.Printf("skipping source: %v: stdin can only be read by get", label)
+			continue
+		}
+		if kubeconfig.IsExpanding(src) {
+			konfigs = append(konfigs, gatherExpanded(dest, label, src)...)
+			continue
+		}
+		k, err := kubeconfig.SourceInit(src, label)
 		if err != nil {
-			log.Fatalf("unable to parse destination: %v: %v", khg.Destination, err)
+			log.Fatalf("unable to parse source: %v: %v", label, err)
 		}
-		k.Label = label
-		k.SrcDef = src
 		konfigs = append(konfigs, k)
 	}
 
 	for _, konfig := range konfigs {
-		err = dest.CopyCurrentContext(konfig)
+		printChanges(konfig)
+		err = dest.CopyContexts(konfig)
 		if err != nil {
+			printConflicts(dest)
 			log.Fatalf("unable merge config: %v: %v", konfig.Url, err)
 		}
 
@@ -84,4 +110,34 @@ func gather(cmd *cobra.Command, args []string) {
 		}
 
 	}
+
+	printConflicts(dest)
+	for _, contextName := range dest.OrphanedContexts(khg.Sources) {
+		owner, _ := dest.ContextOwner(contextName)
+		log.Printf("context %q comes from source %q, which is no longer configured. remove it with: khg delete %s", contextName, owner.Label, contextName)
+	}
+}
+
+// gatherExpanded reads every source an expanding source stands for. Sources that fail are skipped,
+// some of them are usually still being created.
+func gatherExpanded(dest *kubeconfig.KubeConfig, label string, src cfg.Source) []*kubeconfig.KubeConfig {
+	expanded, err := kubeconfig.Expand(label, src)
+	if err != nil {
+		log.Fatalf("unable to expand source: %v: %v", label, err)
+	}
+
+	konfigs := make([]*kubeconfig.KubeConfig, 0, len(expanded))
+	read, errs := kubeconfig.SourceInitAll(expanded)
+	for i, e := range expanded {
+		if errs[i] != nil {
+			log.Printf("skipping source: %v: %v", e.Label, errs[i])
+			continue
+		}
+		konfigs = append(konfigs, read[i])
+	}
+
+	for _, contextName := range dest.StaleContexts(label, expanded) {
+		log.Printf("context %q is no longer found by source %q. remove it with: khg delete %s", contextName, label, contextName)
+	}
+	return konfigs
 }
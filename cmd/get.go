@@ -15,10 +15,13 @@
 package cmd
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stefan-kiss/khg/internal/cfg"
 	"github.com/stefan-kiss/khg/internal/kubeconfig"
+	"github.com/stefan-kiss/khg/internal/kubehttp"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -35,6 +38,27 @@ url examples        : 10.0.0.1:2222/~/.kube.config
 					  10.0.0.1
                       example.com
                       file://~/projects/kubernetes/.kube.config
+                      ssh://ci@build01/home/ci/clusters/*/kubeconfig
+                      file://~/.kube/configs/
+                      ssh://node[01-12].lab/etc/rancher/k3s/k3s.yaml
+                      ansible-inventory://~/infra/inventory.ini?group=k8s_masters&path=/etc/kubernetes/admin.conf
+                      ssh+exec://centos@10.0.0.1?cmd=microk8s+config
+                      https://ci.example.com/artifacts/kubeconfig --token-env CI_TOKEN
+                      k8s-secret://management/default/workload-kubeconfig?key=value
+                      tfstate://~/infra/aks/terraform.tfstate?output=kube_admin_config_raw
+                      - (or stdin://) --label prod, reads stdin. can not be persisted
+                      exec:// --command "kind get kubeconfig --name dev" --label kind-dev
+
+profiles: k3s, rke2, kubeadm, microk8s, k0s and kind configurations are detected (--profile auto) and get
+          the api address of the host, keeping the CA, and names like k3s@label instead of default@label.
+          -a, -r and -i take precedence. --profile none merges the configuration as it is, like for sources
+          saved without a profile.
+
+rules:    --set field=value and --unset field add a rewrite rule to the source, run after the global rules.
+          -a, -r and -i are rules too, run first, so --set server=... or a global rule changes what they did.
+
+contexts: only the current context is merged, unless --all-contexts, --contexts or --context-regex is given.
+          every merged context is renamed to <context>@<label>, or by --context-template (same for clusters and users).
 
 api-address examples: 10.0.0.1:10443
 If using ssh protocol the url path part must start with "/" so use "/./" for current directory and "/~/" for home directory.
@@ -55,6 +79,38 @@ func init() {
 	getCmd.Flags().StringP("kube-port", "k", "", "Kubernetes api port (overrides all other settings)")
 	getCmd.Flags().BoolP("insecure", "i", false, "Will remove the CA from cluster and add the 'insecure-skip-tls-verify' flag.")
 	getCmd.Flags().BoolP("rewrite-api", "r", false, "Will rewrite api address using the host from the url and default port. Use api-address flag to overwrite this option and specify a custom one.")
+	getCmd.Flags().StringP("jump", "J", "", "Comma separated list of jump hosts ([user@]host[:port]) used to reach the source. 'none' ignores ProxyJump from ssh_config.")
+	addSecretFlags(getCmd, "passphrase", "passphrase for encrypted ssh keys")
+	getCmd.Flags().Bool("sudo", false, "Read the source file with 'sudo cat' over ssh. Used automatically when sftp access is denied.")
+	addSecretFlags(getCmd, "sudo-password", "sudo password on the source host")
+	getCmd.Flags().String("command", "", "Run this command (over ssh, or locally for exec:// sources) and read the kube configuration from its output instead of a file.")
+	getCmd.Flags().String("timeout", "", "Timeout for local commands (exec:// sources, default: "+kubeconfig.DefaultExecTimeout.String()+") and downloads (http(s):// sources, default: "+kubehttp.DefaultTimeout.String()+")")
+	getCmd.Flags().StringArray("env", nil, "Environment variable (NAME=value) for local commands (exec:// sources). Can be repeated.")
+	getCmd.Flags().String("dir", "", "Working directory for local commands (exec:// sources)")
+	addSecretFlags(getCmd, "token", "bearer token for http(s) sources")
+	getCmd.Flags().String("username", "", "Basic auth user for http(s) sources")
+	addSecretFlags(getCmd, "password", "basic auth password for http(s) sources")
+	getCmd.Flags().String("ca-file", "", "CA bundle used to verify http(s) sources")
+	getCmd.Flags().Int("max-redirects", 0, fmt.Sprintf("Maximum redirects followed for http(s) sources. Default: %d, -1 disables redirects", kubehttp.DefaultMaxRedirects))
+	getCmd.Flags().String("sha256", "", "Expected SHA-256 (hex) of the downloaded kube configuration")
+	getCmd.Flags().String("kubeconfig", "", "Kube configuration with the context used to read k8s-secret:// sources. Default: the destination")
+	getCmd.Flags().String("label-template", "", "Template for the label of each source a host range, glob or directory source expands to. Default: {{.Label}}-{{.Match}}")
+	addSecretFlags(getCmd, "ssh-password", "ssh password for hosts without a usable key")
+	getCmd.Flags().Bool("copy-id", false, "Install the ssh public key on the source host first (like ssh-copy-id), so later runs need no password")
+	getCmd.Flags().String("identity-file", "", "SSH private key saved with the source, tried before --identity and ssh_config")
+	getCmd.Flags().StringSlice("transport", nil, "Transports to read the source file with, in order. Default: sftp,scp,cat")
+	getCmd.Flags().String("profile", kubeconfig.ProfileAuto, "Distribution profile applied before merging: "+strings.Join(kubeconfig.ProfileNames(), ", "))
+	getCmd.Flags().Bool("all-contexts", false, "Merge all the contexts of the source instead of the current one")
+	getCmd.Flags().StringSlice("contexts", nil, "Merge these contexts of the source instead of the current one")
+	getCmd.Flags().String("context-regex", "", "Merge the contexts of the source matching this regular expression instead of the current one")
+	getCmd.Flags().String("context-template", "", "Go template of the merged context names, with .Label, .Context, .Cluster, .User, .Host and .Distribution. Default: "+kubeconfig.DefaultContextTemplate)
+	getCmd.Flags().String("cluster-template", "", "Go template of the merged cluster names. Default: "+kubeconfig.DefaultClusterTemplate)
+	getCmd.Flags().String("user-template", "", "Go template of the merged user names. Default: "+kubeconfig.DefaultUserTemplate)
+	getCmd.Flags().String("conflict", "", "What to do with names already used in the destination: "+strings.Join(kubeconfig.ConflictPolicies, ", ")+". Default: the conflict setting, else "+kubeconfig.ConflictOverwrite)
+	getCmd.Flags().Bool("dedup", false, "Use the identical cluster or user already in the destination instead of adding a duplicate")
+	getCmd.Flags().StringArray("set", nil, "Rewrite rule of the source: set a field (field=value, a go template) before merging. Can be repeated.")
+	getCmd.Flags().StringSlice("unset", nil, "Rewrite rule of the source: clear these fields before merging")
+	getCmd.Flags().String("host-key-policy", "", "SSH host key policy: strict, ask, accept-new or replace (replaces a changed host key). Defaults to StrictHostKeyChecking from ssh_config.")
 
 }
 
@@ -73,6 +129,19 @@ func add(cmd *cobra.Command, args []string) {
 		log.Fatalf("unable get label from command line: %v", err)
 	}
 
+	if kubeconfig.IsStdin(src.Source) {
+		if label == "" {
+			log.Fatal("--label is required when reading the kube configuration from stdin")
+		}
+		persistent, err := rootCmd.Flags().GetBool("persistent")
+		if err != nil {
+			log.Fatalf("unable get persistent flag: %v", err)
+		}
+		if persistent {
+			log.Fatal("stdin can not be read again by gather, remove --persistent to merge it only once")
+		}
+	}
+
 	insecure, err := cmd.Flags().GetBool("insecure")
 	if err != nil {
 		log.Fatalf("unable get insecure from command line: %v", err)
@@ -108,6 +177,205 @@ func add(cmd *cobra.Command, args []string) {
 		src.OverridePort = kubePort
 	}
 
+	hostKeyPolicy, err := cmd.Flags().GetString("host-key-policy")
+	if err != nil {
+		log.Fatalf("unable get host-key-policy from command line: %v", err)
+	}
+	src.HostKeyPolicy = hostKeyPolicy
+
+	src.Jump, err = cmd.Flags().GetString("jump")
+	if err != nil {
+		log.Fatalf("unable get jump from command line: %v", err)
+	}
+
+	src.Passphrase, err = getSecretFlags(cmd, "passphrase")
+	if err != nil {
+		log.Fatalf("unable get passphrase from command line: %v", err)
+	}
+
+	src.Sudo, err = cmd.Flags().GetBool("sudo")
+	if err != nil {
+		log.Fatalf("unable get sudo from command line: %v", err)
+	}
+
+	src.SudoPassword, err = getSecretFlags(cmd, "sudo-password")
+	if err != nil {
+		log.Fatalf("unable get sudo password from command line: %v", err)
+	}
+
+	src.Command, err = cmd.Flags().GetString("command")
+	if err != nil {
+		log.Fatalf("unable get command from command line: %v", err)
+	}
+
+	src.Timeout, err = cmd.Flags().GetString("timeout")
+	if err != nil {
+		log.Fatalf("unable get timeout from command line: %v", err)
+	}
+
+	src.Env, err = cmd.Flags().GetStringArray("env")
+	if err != nil {
+		log.Fatalf("unable get env from command line: %v", err)
+	}
+
+	src.Dir, err = cmd.Flags().GetString("dir")
+	if err != nil {
+		log.Fatalf("unable get dir from command line: %v", err)
+	}
+
+	src.Token, err = getSecretFlags(cmd, "token")
+	if err != nil {
+		log.Fatalf("unable get token from command line: %v", err)
+	}
+
+	src.Username, err = cmd.Flags().GetString("username")
+	if err != nil {
+		log.Fatalf("unable get username from command line: %v", err)
+	}
+
+	src.Password, err = getSecretFlags(cmd, "password")
+	if err != nil {
+		log.Fatalf("unable get password from command line: %v", err)
+	}
+
+	src.CaFile, err = cmd.Flags().GetString("ca-file")
+	if err != nil {
+		log.Fatalf("unable get ca-file from command line: %v", err)
+	}
+
+	src.MaxRedirects, err = cmd.Flags().GetInt("max-redirects")
+	if err != nil {
+		log.Fatalf("unable get max-redirects from command line: %v", err)
+	}
+
+	src.Sha256, err = cmd.Flags().GetString("sha256")
+	if err != nil {
+		log.Fatalf("unable get sha256 from command line: %v", err)
+	}
+
+	src.Kubeconfig, err = cmd.Flags().GetString("kubeconfig")
+	if err != nil {
+		log.Fatalf("unable get kubeconfig from command line: %v", err)
+	}
+
+	src.Transports, err = cmd.Flags().GetStringSlice("transport")
+	if err != nil {
+		log.Fatalf("unable get transport from command line: %v", err)
+	}
+
+	src.IdentityFile, err = cmd.Flags().GetString("identity-file")
+	if err != nil {
+		log.Fatalf("unable get identity-file from command line: %v", err)
+	}
+
+	src.SshPassword, err = getSecretFlags(cmd, "ssh-password")
+	if err != nil {
+		log.Fatalf("unable get ssh-password from command line: %v", err)
+	}
+
+	src.CopyId, err = cmd.Flags().GetBool("copy-id")
+	if err != nil {
+		log.Fatalf("unable get copy-id from command line: %v", err)
+	}
+
+	src.LabelTemplate, err = cmd.Flags().GetString("label-template")
+	if err != nil {
+		log.Fatalf("unable get label-template from command line: %v", err)
+	}
+
+	src.Profile, err = cmd.Flags().GetString("profile")
+	if err != nil {
+		log.Fatalf("unable get profile from command line: %v", err)
+	}
+	err = kubeconfig.CheckProfile(src.Profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	src.AllContexts, err = cmd.Flags().GetBool("all-contexts")
+	if err != nil {
+		log.Fatalf("unable get all-contexts from command line: %v", err)
+	}
+	src.Contexts, err = cmd.Flags().GetStringSlice("contexts")
+	if err != nil {
+		log.Fatalf("unable get contexts from command line: %v", err)
+	}
+	src.ContextRegex, err = cmd.Flags().GetString("context-regex")
+	if err != nil {
+		log.Fatalf("unable get context-regex from command line: %v", err)
+	}
+
+	naming := cfg.Naming{}
+	for _, t := range []struct {
+		flag     string
+		template *string
+	}{
+		{"context-template", &naming.Context},
+		{"cluster-template", &naming.Cluster},
+		{"user-template", &naming.User},
+	} {
+		*t.template, err = cmd.Flags().GetString(t.flag)
+		if err != nil {
+			log.Fatalf("unable get %s from command line: %v", t.flag, err)
+		}
+	}
+	if naming != (cfg.Naming{}) {
+		src.Naming = &naming
+	}
+	err = kubeconfig.CheckNaming(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	src.Conflict, err = cmd.Flags().GetString("conflict")
+	if err != nil {
+		log.Fatalf("unable get conflict from command line: %v", err)
+	}
+	err = kubeconfig.CheckConflict(src.Conflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src.Dedup, err = cmd.Flags().GetBool("dedup")
+	if err != nil {
+		log.Fatalf("unable get dedup from command line: %v", err)
+	}
+
+	rule := cfg.Rule{}
+	set, err := cmd.Flags().GetStringArray("set")
+	if err != nil {
+		log.Fatalf("unable get set from command line: %v", err)
+	}
+	for _, s := range set {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("invalid set value: %q, use field=value", s)
+		}
+		if rule.Set == nil {
+			rule.Set = make(map[string]string)
+		}
+		rule.Set[kv[0]] = kv[1]
+	}
+	rule.Unset, err = cmd.Flags().GetStringSlice("unset")
+	if err != nil {
+		log.Fatalf("unable get unset from command line: %v", err)
+	}
+	if len(rule.Set) > 0 || len(rule.Unset) > 0 {
+		src.Rewrite = append(src.Rewrite, rule)
+	}
+	rules, err := kubeconfig.Rules(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = kubeconfig.CheckRules(rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if kubeconfig.IsExpanding(src) {
+		getExpanded(configUsed, src, label)
+		return
+	}
+
 	sourceKonfig, err := kubeconfig.SourceInit(src, label)
 	if err != nil {
 		log.Fatalf("unable to parse source: %v: %v", src.Source, err)
@@ -115,17 +383,33 @@ func add(cmd *cobra.Command, args []string) {
 	if label != "" {
 		sourceKonfig.Label = label
 	} else {
-		sourceKonfig.Label = sourceKonfig.Url.Host
+		sourceKonfig.Label = sourceKonfig.DefaultLabel()
+	}
+	if sourceKonfig.Label == "" {
+		log.Fatalf("unable to determine a label for source: %v. use --label", src.Source)
 	}
 
 	log.Debugf("label: %s", sourceKonfig.Label)
+	printChanges(sourceKonfig)
 
 	destKonfig, err := kubeconfig.DestInit(configUsed.Destination)
 	if err != nil {
 		log.Fatalf("unable to initialize destination file %s: %v", configUsed.Destination, err)
 	}
+	// the label is taken by this source, saved or not
+	sources := map[string]cfg.Source{sourceKonfig.Label: src}
+	for l, s := range configUsed.Sources {
+		if l != sourceKonfig.Label {
+			sources[l] = s
+		}
+	}
+	err = destKonfig.AdoptLegacy(sources)
+	if err != nil {
+		log.Fatalf("unable to record the owner of entries merged by older versions: %v", err)
+	}
 
 	err = destKonfig.MergeOne(sourceKonfig)
+	printConflicts(destKonfig)
 	if err != nil {
 		log.Fatalf("unable source into destination %s: %v", src.Source, err)
 	}
@@ -142,3 +426,122 @@ func add(cmd *cobra.Command, args []string) {
 		}
 	}
 }
+
+// getExpanded merges all the sources an expanding source stands for and saves the expanding source itself.
+func getExpanded(configUsed cfg.Cfg, src cfg.Source, label string) {
+	if label == "" {
+		label = kubeconfig.ExpandingLabel(src)
+	}
+	if label == "" {
+		log.Fatalf("unable to determine a label for source: %v. use --label", src.Source)
+	}
+
+	destKonfig, err := kubeconfig.DestInit(configUsed.Destination)
+	if err != nil {
+		log.Fatalf("unable to initialize destination file %s: %v", configUsed.Destination, err)
+	}
+	err = mergeExpanded(destKonfig, label, src)
+	if err != nil {
+		log.Fatalf("unable to expand source: %v: %v", src.Source, err)
+	}
+
+	persistent, err := rootCmd.Flags().GetBool("persistent")
+	if err != nil {
+		log.Fatalf("unable get persistent flag: %v", err)
+	}
+	if persistent {
+		err := cfg.Add(&configUsed, label, src)
+		if err != nil {
+			log.Fatalf("unable to save config file: %v", err)
+		}
+	}
+}
+
+// mergeExpanded merges every source the expanding source stands for and reports the contexts that are gone.
+// Sources that can not be read are skipped.
+func mergeExpanded(destKonfig *kubeconfig.KubeConfig, label string, src cfg.Source) error {
+	expanded, err := kubeconfig.Expand(label, src)
+	if err != nil {
+		return err
+	}
+	log.Infof("source %q expands to %d sources", label, len(expanded))
+
+	konfigs, errs := kubeconfig.SourceInitAll(expanded)
+	for i, e := range expanded {
+		if errs[i] != nil {
+			log.Errorf("skipping source: %v: %v", e.Label, errs[i])
+			continue
+		}
+		printChanges(konfigs[i])
+		err = destKonfig.MergeOne(konfigs[i])
+		if err != nil {
+			log.Errorf("unable to merge source: %v: %v", e.Label, err)
+			continue
+		}
+		fmt.Printf("%-30s | %s\n", e.Label, e.Source.Source)
+	}
+	printConflicts(destKonfig)
+	for _, contextName := range destKonfig.StaleContexts(label, expanded) {
+		log.Warnf("context %q is no longer found by source %q. remove it with: khg delete %s", contextName, label, contextName)
+	}
+	return nil
+}
+
+// printConflicts prints the names merging ran into and the duplicates it found.
+func printConflicts(k *kubeconfig.KubeConfig) {
+	if len(k.Conflicts) == 0 {
+		return
+	}
+	fmt.Printf("%-8s | %-40s | %-20s | %-20s | %s\n", "Kind", "Name", "Label", "Owner", "Action")
+	for _, c := range k.Conflicts {
+		owner := c.Owner
+		if owner == "" {
+			owner = "-"
+		}
+		fmt.Printf("%-8s | %-40s | %-20s | %-20s | %s\n", c.Kind, c.Name, c.Label, owner, c.Action)
+	}
+	k.Conflicts = nil
+}
+
+// printChanges prints what the rewrite rules changed in the source, when asked to with --explain.
+func printChanges(k *kubeconfig.KubeConfig) {
+	if !viper.GetBool("explain") {
+		return
+	}
+	if len(k.Changes) == 0 {
+		fmt.Printf("%s: no changes by rewrite rules\n", k.Label)
+		return
+	}
+	fmt.Printf("%-20s | %-20s | %-8s | %-30s | %-24s | %-30s | %s\n", "Label", "Rule", "Kind", "Name", "Field", "Old", "New")
+	for _, c := range k.Changes {
+		fmt.Printf("%-20s | %-20s | %-8s | %-30s | %-24s | %-30s | %s\n", k.Label, c.Rule, c.Kind, c.Name, c.Field, c.Old, c.New)
+	}
+}
+
+// addSecretFlags adds the flags needed to reference a secret instead of passing it on the command line.
+func addSecretFlags(cmd *cobra.Command, name string, usage string) {
+	cmd.Flags().String(name+"-env", "", "Environment variable holding the "+usage)
+	cmd.Flags().String(name+"-file", "", "File holding the "+usage)
+	cmd.Flags().String(name+"-command", "", "Command printing the "+usage)
+}
+
+func getSecretFlags(cmd *cobra.Command, name string) (*cfg.Secret, error) {
+	var err error
+	s := cfg.Secret{}
+	s.Env, err = cmd.Flags().GetString(name + "-env")
+	if err != nil {
+		return nil, err
+	}
+	s.File, err = cmd.Flags().GetString(name + "-file")
+	if err != nil {
+		return nil, err
+	}
+	s.Command, err = cmd.Flags().GetString(name + "-command")
+	if err != nil {
+		return nil, err
+	}
+	if s == (cfg.Secret{}) {
+		return nil, nil
+	}
+	return &s, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/kubeconfig"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Imports sources from other tools.",
+	Long: `Imports sources from other tools.
+Without the 'persistent' global flag the sources are only printed.`,
+}
+
+// importAnsibleCmd represents the import ansible command
+var importAnsibleCmd = &cobra.Command{
+	Use:   "ansible <inventory>",
+	Short: "Imports the hosts of an Ansible inventory as ssh sources.",
+	Long: `Imports the hosts of an Ansible inventory (INI or YAML) as ssh sources.
+ansible_host, ansible_user, ansible_port and ansible_ssh_private_key_file are used to reach the hosts.
+host_vars and group_vars directories are not read.
+
+Every host becomes a source labeled from --label-template, default: {{.Match}} (the inventory hostname).
+With --live one ansible-inventory:// source is added instead, it reads the inventory again on every gather.
+
+examples:
+  khg import ansible inventory.ini --group k8s_masters -p
+  khg import ansible inventory.yaml --group k8s_masters --path /etc/kubernetes/admin.conf --live -l lab -p
+`,
+	Args: cobra.ExactArgs(1),
+	Run:  importAnsible,
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.AddCommand(importAnsibleCmd)
+
+	importAnsibleCmd.Flags().StringP("group", "g", "", "Inventory group to import, with its children. Default: all")
+	importAnsibleCmd.Flags().String("path", "", "Path of the kube configuration on the hosts. Default: probe the known locations")
+	importAnsibleCmd.Flags().Bool("live", false, "Add one ansible-inventory:// source instead of one source per host")
+	importAnsibleCmd.Flags().StringP("label", "l", "", "Label of the --live source. Default: the group, else the inventory name")
+	importAnsibleCmd.Flags().String("label-template", "", "Template for the label of each host. Default: {{.Match}}, with --live: {{.Label}}-{{.Match}}")
+	importAnsibleCmd.Flags().Bool("overwrite", false, "Replace sources with the same label")
+	importAnsibleCmd.Flags().BoolP("insecure", "i", false, "Will remove the CA from the clusters and add the 'insecure-skip-tls-verify' flag.")
+	importAnsibleCmd.Flags().BoolP("sudo", "s", false, "Read the kube configuration with sudo")
+	importAnsibleCmd.Flags().String("profile", kubeconfig.ProfileAuto, "Distribution profile applied before merging: "+strings.Join(kubeconfig.ProfileNames(), ", "))
+}
+
+func importAnsible(cmd *cobra.Command, args []string) {
+	configUsed := cfg.Cfg{}
+	err := viper.Unmarshal(&configUsed)
+	if err != nil {
+		log.Fatalf("unable to Unmarshal config file: %v", err)
+	}
+	if configUsed.Sources == nil {
+		configUsed.Sources = make(map[string]cfg.Source)
+	}
+
+	inventory, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("unable to find inventory: %v", err)
+	}
+	query := url.Values{}
+	for _, name := range []string{"group", "path"} {
+		value, err := cmd.Flags().GetString(name)
+		if err != nil {
+			log.Fatalf("unable get %s from command line: %v", name, err)
+		}
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	u := url.URL{Scheme: "ansible-inventory", Path: filepath.ToSlash(inventory), RawQuery: query.Encode()}
+
+	src := cfg.Source{Source: u.String()}
+	src.LabelTemplate, err = cmd.Flags().GetString("label-template")
+	if err != nil {
+		log.Fatalf("unable get label-template from command line: %v", err)
+	}
+	src.Insecure, err = cmd.Flags().GetBool("insecure")
+	if err != nil {
+		log.Fatalf("unable get insecure from command line: %v", err)
+	}
+	src.Sudo, err = cmd.Flags().GetBool("sudo")
+	if err != nil {
+		log.Fatalf("unable get sudo from command line: %v", err)
+	}
+	src.Profile, err = cmd.Flags().GetString("profile")
+	if err != nil {
+		log.Fatalf("unable get profile from command line: %v", err)
+	}
+	err = kubeconfig.CheckProfile(src.Profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	live, err := cmd.Flags().GetBool("live")
+	if err != nil {
+		log.Fatalf("unable get live from command line: %v", err)
+	}
+	overwrite, err := cmd.Flags().GetBool("overwrite")
+	if err != nil {
+		log.Fatalf("unable get overwrite from command line: %v", err)
+	}
+	label, err := cmd.Flags().GetString("label")
+	if err != nil {
+		log.Fatalf("unable get label from command line: %v", err)
+	}
+	if label == "" {
+		label = kubeconfig.ExpandingLabel(src)
+	}
+
+	sources := make(map[string]cfg.Source)
+	order := make([]string, 0)
+	if live {
+		sources[label] = src
+		order = append(order, label)
+	} else {
+		if src.LabelTemplate == "" {
+			src.LabelTemplate = "{{.Match}}"
+		}
+		expanded, err := kubeconfig.Expand(label, src)
+		if err != nil {
+			log.Fatalf("unable to import inventory: %v", err)
+		}
+		for _, e := range expanded {
+			sources[e.Label] = e.Source
+			order = append(order, e.Label)
+		}
+	}
+
+	for _, l := range order {
+		if _, ok := configUsed.Sources[l]; ok && !overwrite {
+			log.Warnf("skipping source: %q already exists. use --overwrite to replace it", l)
+			continue
+		}
+		configUsed.Sources[l] = sources[l]
+		fmt.Printf("%-30s | %s\n", l, sources[l].Source)
+	}
+
+	persistent, err := rootCmd.Flags().GetBool("persistent")
+	if err != nil {
+		log.Fatalf("unable get persistent flag: %v", err)
+	}
+	if !persistent {
+		log.Infof("sources not saved, use -p to add them to the config file")
+		return
+	}
+	err = cfg.Save(&configUsed)
+	if err != nil {
+		log.Fatalf("unable to save config file: %v", err)
+	}
+}
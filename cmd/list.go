@@ -22,7 +22,7 @@ import (
 	"github.com/spf13/viper"
 	"github.com/stefan-kiss/khg/internal/cfg"
 	"github.com/stefan-kiss/khg/internal/kubeconfig"
-	"strings"
+	"sort"
 )
 
 // listCmd represents the list command
@@ -32,8 +32,8 @@ var listCmd = &cobra.Command{
 	Long: `Lists the current contexts from the kubernetes config file.
 Optionally if the '-p/-persistent' flag is supplied the config file entries are also listed.
 
-Matching with the config file label is done by extracting the label from the context name assuming the following format for it:
-{{ initial_context_name }}@{{ label }}
+Contexts are matched with the config file labels through the owner khg records in the "khg" extension of the
+contexts it merges. Contexts merged by older versions, named <context>@<label>, are matched by their name.
 
 `,
 	Run: listCtx,
@@ -69,24 +69,25 @@ func listCtx(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalf("unable to initialize destination file %q: %v", configUsed.Destination, err)
 	}
+	err = destKonfig.AdoptLegacy(configUsed.Sources)
+	if err != nil {
+		log.Fatalf("unable to record the owner of entries merged by older versions: %v", err)
+	}
 
-	for cfgLabel, source := range configUsed.Sources {
-		foundCtx := ""
-		for ctxLabel, context := range destKonfig.Config.Contexts {
-			if strings.HasSuffix(ctxLabel, "@"+cfgLabel) {
-				foundCtx = ctxLabel
-				table = append(table, listHead{
-					ConfigLabel:       cfgLabel,
-					SourceUrl:         source.Source,
-					KubernetesContext: ctxLabel,
-					ApiAddress:        destKonfig.Config.Clusters[context.Cluster].Server,
-				})
-			}
-			break
+	for _, cfgLabel := range sourceLabels(configUsed.Sources) {
+		source := configUsed.Sources[cfgLabel]
+		contexts := destKonfig.OwnedContexts(cfgLabel, kubeconfig.IsExpanding(source))
+		for _, ctxLabel := range contexts {
+			context := destKonfig.Config.Contexts[ctxLabel]
+			table = append(table, listHead{
+				ConfigLabel:       cfgLabel,
+				SourceUrl:         source.Source,
+				KubernetesContext: ctxLabel,
+				ApiAddress:        apiAddress(destKonfig, context.Cluster),
+			})
+			delete(destKonfig.Config.Contexts, ctxLabel)
 		}
-		if foundCtx != "" {
-			delete(destKonfig.Config.Contexts, foundCtx)
-		} else {
+		if len(contexts) == 0 {
 			table = append(table, listHead{
 				ConfigLabel: cfgLabel,
 				SourceUrl:   source.Source,
@@ -98,7 +99,7 @@ func listCtx(cmd *cobra.Command, args []string) {
 			ConfigLabel:       "",
 			SourceUrl:         "",
 			KubernetesContext: ctxLabel,
-			ApiAddress:        destKonfig.Config.Clusters[context.Cluster].Server,
+			ApiAddress:        apiAddress(destKonfig, context.Cluster),
 		})
 	}
 	for _, tblElem := range table {
@@ -110,3 +111,20 @@ func listCtx(cmd *cobra.Command, args []string) {
 		)
 	}
 }
+
+// sourceLabels returns the labels of the sources, sorted.
+func sourceLabels(sources map[string]cfg.Source) []string {
+	labels := make([]string, 0, len(sources))
+	for label := range sources {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func apiAddress(k *kubeconfig.KubeConfig, cluster string) string {
+	if c, ok := k.Config.Clusters[cluster]; ok {
+		return c.Server
+	}
+	return ""
+}
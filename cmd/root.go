@@ -19,6 +19,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/kubesftp"
 	"os"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -42,6 +43,14 @@ Merge them in one config file ready to be used by tools like kubectx
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+
+	// sources on the same host share one ssh connection for the whole run
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		kubesftp.EnablePool()
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		kubesftp.ClosePool()
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -67,6 +76,10 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("persistent", "p", false, "persist any changes to config file")
 	rootCmd.PersistentFlags().StringP("identity", "I", "", "ssh private key")
 	rootCmd.PersistentFlags().StringP("log-level", "L", "INFO", "Log Level. Default INFO")
+	rootCmd.PersistentFlags().Bool("control-master", false, "reuse running OpenSSH ControlMaster connections of the source hosts and first jump hosts (ControlPath in ssh_config)")
+	viper.BindPFlag("controlmaster", rootCmd.PersistentFlags().Lookup("control-master"))
+	rootCmd.PersistentFlags().Bool("explain", false, "print the changes the rewrite rules made to each source")
+	viper.BindPFlag("explain", rootCmd.PersistentFlags().Lookup("explain"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -0,0 +1,501 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package ansible reads the hosts of an Ansible inventory, INI or YAML.
+package ansible
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/goccy/go-yaml"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AllGroup holds every host of the inventory.
+const AllGroup = "all"
+
+// Host is an inventory host with the variables used to reach it.
+type Host struct {
+	// Name is the inventory hostname
+	Name string
+	// Address is ansible_host, the name when not set
+	Address      string
+	User         string
+	Port         int
+	IdentityFile string
+}
+
+type group struct {
+	hosts    []string
+	children []string
+	vars     map[string]string
+}
+
+// Inventory is the parsed inventory, without host_vars and group_vars directories.
+type Inventory struct {
+	groups map[string]*group
+	// host variables, in the order the hosts were found
+	hosts     map[string]map[string]string
+	hostOrder []string
+	// dir is the directory of the inventory file, relative key files are in it
+	dir string
+}
+
+func newInventory() *Inventory {
+	return &Inventory{
+		groups: map[string]*group{AllGroup: newGroup()},
+		hosts:  make(map[string]map[string]string),
+	}
+}
+
+func newGroup() *group {
+	return &group{vars: make(map[string]string)}
+}
+
+func (inv *Inventory) group(name string) *group {
+	g, ok := inv.groups[name]
+	if !ok {
+		g = newGroup()
+		inv.groups[name] = g
+	}
+	return g
+}
+
+func (inv *Inventory) addHost(groupName string, name string, vars map[string]string) {
+	hostVars, ok := inv.hosts[name]
+	if !ok {
+		hostVars = make(map[string]string)
+		inv.hosts[name] = hostVars
+		inv.hostOrder = append(inv.hostOrder, name)
+	}
+	for k, v := range vars {
+		hostVars[k] = v
+	}
+	g := inv.group(groupName)
+	for _, h := range g.hosts {
+		if h == name {
+			return
+		}
+	}
+	g.hosts = append(g.hosts, name)
+}
+
+// Load reads an inventory file. Files ending in .yml or .yaml are YAML inventories, all others INI.
+func Load(path string) (*Inventory, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read inventory: %v", err)
+	}
+	var inv *Inventory
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		inv, err = ParseYaml(contents)
+	default:
+		inv, err = ParseIni(contents)
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv.dir = filepath.Dir(path)
+	return inv, nil
+}
+
+// hostPattern matches the ranges in inventory host names: node[01:12] or node[a:c].
+var hostPattern = regexp.MustCompile(`\[([0-9]+|[a-z]):([0-9]+|[a-z])(?::([0-9]+))?\]`)
+
+// expandHostPattern expands the first range in the host name, recursively for the next ones.
+func expandHostPattern(name string) ([]string, error) {
+	loc := hostPattern.FindStringSubmatchIndex(name)
+	if loc == nil {
+		return []string{name}, nil
+	}
+	first, last := name[loc[2]:loc[3]], name[loc[4]:loc[5]]
+	step := 1
+	if loc[6] >= 0 {
+		step, _ = strconv.Atoi(name[loc[6]:loc[7]])
+		if step < 1 {
+			return nil, fmt.Errorf("invalid step in host pattern: %q", name)
+		}
+	}
+
+	values := make([]string, 0)
+	if a, err := strconv.Atoi(first); err == nil {
+		b, err := strconv.Atoi(last)
+		if err != nil || b < a {
+			return nil, fmt.Errorf("invalid host pattern: %q", name)
+		}
+		width := 0
+		if len(first) > 1 && strings.HasPrefix(first, "0") {
+			width = len(first)
+		}
+		for n := a; n <= b; n += step {
+			values = append(values, fmt.Sprintf("%0*d", width, n))
+		}
+	} else {
+		if len(last) != 1 || last[0] < first[0] {
+			return nil, fmt.Errorf("invalid host pattern: %q", name)
+		}
+		for c := first[0]; c <= last[0]; c += byte(step) {
+			values = append(values, string(c))
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		expanded, err := expandHostPattern(name[:loc[0]] + v + name[loc[1]:])
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, expanded...)
+	}
+	return names, nil
+}
+
+// splitVars splits key=value pairs, values can be quoted.
+func splitVars(line string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			break
+		}
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected key=value: %q", line)
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+
+		var value string
+		if len(line) > 0 && (line[0] == '"' || line[0] == '\'') {
+			end := strings.IndexByte(line[1:], line[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in value of: %q", key)
+			}
+			value = line[1 : end+1]
+			line = line[end+2:]
+		} else {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
+
+// hostPort moves the port of a host:port name to ansible_port.
+func hostPort(name string, vars map[string]string) (string, map[string]string) {
+	i := strings.LastIndex(name, ":")
+	if i < 0 {
+		return name, vars
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return name, vars
+	}
+	withPort := map[string]string{"ansible_port": name[i+1:]}
+	for k, v := range vars {
+		withPort[k] = v
+	}
+	return name[:i], withPort
+}
+
+// ParseIni parses an INI inventory: [group], [group:vars] and [group:children] sections.
+func ParseIni(contents []byte) (*Inventory, error) {
+	inv := newInventory()
+	section, kind := "ungrouped", ""
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, kind = line[1:len(line)-1], ""
+			if i := strings.Index(section, ":"); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: unknown section type: %q", lineNumber, kind)
+			}
+			inv.group(section)
+			continue
+		}
+
+		switch kind {
+		case "vars":
+			vars, err := splitVars(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			for k, v := range vars {
+				inv.group(section).vars[k] = v
+			}
+		case "children":
+			g := inv.group(section)
+			g.children = append(g.children, strings.Fields(line)[0])
+			inv.group(strings.Fields(line)[0])
+		default:
+			// the host name, then key=value pairs separated by any whitespace
+			name, rest := line, ""
+			if i := strings.IndexAny(line, " \t"); i >= 0 {
+				name, rest = line[:i], line[i:]
+			}
+			vars, err := splitVars(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			names, err := expandHostPattern(name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			for _, name := range names {
+				name, hostVars := hostPort(name, vars)
+				inv.addHost(section, name, hostVars)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// yamlGroup is a group of a YAML inventory.
+type yamlGroup struct {
+	Hosts    map[string]map[string]interface{} `yaml:"hosts"`
+	Vars     map[string]interface{}            `yaml:"vars"`
+	Children map[string]*yamlGroup             `yaml:"children"`
+}
+
+// ParseYaml parses a YAML inventory.
+func ParseYaml(contents []byte) (*Inventory, error) {
+	groups := make(map[string]*yamlGroup)
+	err := yaml.Unmarshal(contents, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse inventory: %v", err)
+	}
+	inv := newInventory()
+	for _, name := range sortedKeys(groups) {
+		err = inv.addYamlGroup(name, groups[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+func (inv *Inventory) addYamlGroup(name string, yg *yamlGroup) error {
+	g := inv.group(name)
+	if yg == nil {
+		return nil
+	}
+	for k, v := range yg.Vars {
+		g.vars[k] = fmt.Sprint(v)
+	}
+	// maps have no order, the hosts are sorted by name
+	hostVars := make(map[string]map[string]string)
+	for pattern, patternVars := range yg.Hosts {
+		vars := make(map[string]string)
+		for k, v := range patternVars {
+			vars[k] = fmt.Sprint(v)
+		}
+		names, err := expandHostPattern(pattern)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			hostVars[n] = vars
+		}
+	}
+	hostNames := make([]string, 0, len(hostVars))
+	for n := range hostVars {
+		hostNames = append(hostNames, n)
+	}
+	sort.Strings(hostNames)
+	for _, n := range hostNames {
+		inv.addHost(name, n, hostVars[n])
+	}
+	for _, child := range sortedKeys(yg.Children) {
+		g.children = append(g.children, child)
+		err := inv.addYamlGroup(child, yg.Children[child])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(groups map[string]*yamlGroup) []string {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// groupHosts returns the hosts of the group and of all its children, the first time they are found.
+func (inv *Inventory) groupHosts(name string, seen map[string]bool, visited map[string]bool) []string {
+	if visited[name] {
+		return nil
+	}
+	visited[name] = true
+	g := inv.groups[name]
+	hosts := make([]string, 0)
+	for _, h := range g.hosts {
+		if !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	for _, child := range g.children {
+		hosts = append(hosts, inv.groupHosts(child, seen, visited)...)
+	}
+	return hosts
+}
+
+// hostGroups returns the groups the host belongs to, parents before their children.
+func (inv *Inventory) hostGroups(host string) []string {
+	depth := make(map[string]int)
+	var walk func(name string, d int)
+	walk = func(name string, d int) {
+		if current, ok := depth[name]; (ok && current >= d) || d > len(inv.groups) {
+			// a loop in the children otherwise
+			return
+		}
+		depth[name] = d
+		for _, child := range inv.groups[name].children {
+			walk(child, d+1)
+		}
+	}
+	walk(AllGroup, 0)
+	for name := range inv.groups {
+		if _, ok := depth[name]; !ok {
+			// top level groups of INI inventories are children of all
+			walk(name, 1)
+		}
+	}
+
+	groups := make([]string, 0)
+	for name := range inv.groups {
+		if name == AllGroup || inv.hasHost(name, host, make(map[string]bool)) {
+			groups = append(groups, name)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if depth[groups[i]] != depth[groups[j]] {
+			return depth[groups[i]] < depth[groups[j]]
+		}
+		return groups[i] < groups[j]
+	})
+	return groups
+}
+
+func (inv *Inventory) hasHost(name string, host string, visited map[string]bool) bool {
+	if visited[name] {
+		return false
+	}
+	visited[name] = true
+	g := inv.groups[name]
+	for _, h := range g.hosts {
+		if h == host {
+			return true
+		}
+	}
+	for _, child := range g.children {
+		if inv.hasHost(child, host, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// vars returns the variables of the host: the ones of its groups, parents first, then its own.
+func (inv *Inventory) vars(host string) map[string]string {
+	vars := make(map[string]string)
+	for _, g := range inv.hostGroups(host) {
+		for k, v := range inv.groups[g].vars {
+			vars[k] = v
+		}
+	}
+	for k, v := range inv.hosts[host] {
+		vars[k] = v
+	}
+	return vars
+}
+
+// Hosts returns the hosts of the group, and of its children, with their connection variables.
+func (inv *Inventory) Hosts(groupName string) ([]Host, error) {
+	if groupName == "" {
+		groupName = AllGroup
+	}
+	var names []string
+	if groupName == AllGroup {
+		names = inv.hostOrder
+	} else {
+		if _, ok := inv.groups[groupName]; !ok {
+			return nil, fmt.Errorf("group not found in inventory: %q", groupName)
+		}
+		names = inv.groupHosts(groupName, make(map[string]bool), make(map[string]bool))
+	}
+
+	hosts := make([]Host, 0, len(names))
+	for _, name := range names {
+		vars := inv.vars(name)
+		h := Host{
+			Name:         name,
+			Address:      vars["ansible_host"],
+			User:         vars["ansible_user"],
+			IdentityFile: vars["ansible_ssh_private_key_file"],
+		}
+		// the names before ansible 2.0
+		if h.Address == "" {
+			h.Address = vars["ansible_ssh_host"]
+		}
+		if h.Address == "" {
+			h.Address = name
+		}
+		if h.User == "" {
+			h.User = vars["ansible_ssh_user"]
+		}
+		for _, key := range []string{"ansible_port", "ansible_ssh_port"} {
+			port := vars[key]
+			if port == "" {
+				continue
+			}
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s for %q: %q", key, name, port)
+			}
+			h.Port = p
+			break
+		}
+		if h.IdentityFile != "" && inv.dir != "" && !filepath.IsAbs(h.IdentityFile) && !strings.HasPrefix(h.IdentityFile, "~") {
+			h.IdentityFile = filepath.Join(inv.dir, h.IdentityFile)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ansible
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testIni = `
+# control plane
+[k8s_masters]
+master[01:02].lab ansible_user=centos
+master03.lab:2222 ansible_host=10.0.0.3 ansible_ssh_private_key_file="~/.ssh/lab key"
+
+[k8s_workers]
+worker1.lab
+
+[k8s:children]
+k8s_masters
+k8s_workers
+
+[k8s:vars]
+ansible_user=ubuntu
+ansible_port=22
+
+[all:vars]
+ansible_user=root
+`
+
+const testYaml = `
+all:
+  vars:
+    ansible_user: root
+  children:
+    k8s:
+      vars:
+        ansible_user: ubuntu
+        ansible_port: 22
+      children:
+        k8s_masters:
+          hosts:
+            master[01:02].lab:
+              ansible_user: centos
+            master03.lab:
+              ansible_host: 10.0.0.3
+              ansible_port: 2222
+              ansible_ssh_private_key_file: ~/.ssh/lab key
+        k8s_workers:
+          hosts:
+            worker1.lab:
+`
+
+func TestHosts(t *testing.T) {
+	masters := []Host{
+		{Name: "master01.lab", Address: "master01.lab", User: "centos", Port: 22},
+		{Name: "master02.lab", Address: "master02.lab", User: "centos", Port: 22},
+		{Name: "master03.lab", Address: "10.0.0.3", User: "ubuntu", Port: 2222, IdentityFile: "~/.ssh/lab key"},
+	}
+	worker := Host{Name: "worker1.lab", Address: "worker1.lab", User: "ubuntu", Port: 22}
+
+	tests := []struct {
+		name    string
+		parse   func([]byte) (*Inventory, error)
+		source  string
+		group   string
+		want    []Host
+		wantErr bool
+	}{
+		{name: "IniGroup", parse: ParseIni, source: testIni, group: "k8s_masters", want: masters},
+		{name: "IniChildren", parse: ParseIni, source: testIni, group: "k8s", want: append(masters, worker)},
+		{name: "IniAll", parse: ParseIni, source: testIni, group: "", want: append(masters, worker)},
+		{name: "IniMissingGroup", parse: ParseIni, source: testIni, group: "etcd", wantErr: true},
+		{name: "YamlGroup", parse: ParseYaml, source: testYaml, group: "k8s_masters", want: masters},
+		{name: "YamlChildren", parse: ParseYaml, source: testYaml, group: "k8s", want: append(masters, worker)},
+		{name: "BadIni", parse: ParseIni, source: "[k8s]\nnode1 ansible_user", wantErr: true},
+		{name: "BadSection", parse: ParseIni, source: "[k8s:other]\n", wantErr: true},
+		{name: "BadPort", parse: ParseIni, source: "[k8s]\nnode1 ansible_port=ssh", group: "k8s", wantErr: true},
+		{
+			name:   "IniWhitespace",
+			parse:  ParseIni,
+			source: "[k8s]\nnode1\tansible_user=centos   ansible_ssh_private_key_file='/keys/lab key'\t ansible_port=2222\n",
+			group:  "k8s",
+			want:   []Host{{Name: "node1", Address: "node1", User: "centos", Port: 2222, IdentityFile: "/keys/lab key"}},
+		},
+		{
+			name:   "IniSshVars",
+			parse:  ParseIni,
+			source: "[k8s]\nnode1 ansible_ssh_host=10.0.0.1 ansible_ssh_port=2222 ansible_ssh_user=centos\nnode2 ansible_host=10.0.0.2 ansible_ssh_host=10.0.0.9 ansible_port=22 ansible_ssh_port=2222\n",
+			group:  "k8s",
+			want: []Host{
+				{Name: "node1", Address: "10.0.0.1", User: "centos", Port: 2222},
+				{Name: "node2", Address: "10.0.0.2", Port: 22},
+			},
+		},
+		{name: "BadSshPort", parse: ParseIni, source: "[k8s]\nnode1 ansible_ssh_port=ssh", group: "k8s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := tt.parse([]byte(tt.source))
+			var got []Host
+			if err == nil {
+				got, err = inv.Hosts(tt.group)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Hosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Hosts() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandHostPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Plain", pattern: "node1", want: []string{"node1"}},
+		{name: "Numeric", pattern: "node[01:03]", want: []string{"node01", "node02", "node03"}},
+		{name: "Step", pattern: "node[1:5:2]", want: []string{"node1", "node3", "node5"}},
+		{name: "Letters", pattern: "db-[a:c]", want: []string{"db-a", "db-b", "db-c"}},
+		{name: "Two", pattern: "r[1:2]n[1:2]", want: []string{"r1n1", "r1n2", "r2n1", "r2n2"}},
+		{name: "Reversed", pattern: "node[3:1]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandHostPattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandHostPattern() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandHostPattern() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	inventory := filepath.Join(dir, "hosts.ini")
+	err := ioutil.WriteFile(inventory, []byte("[k8s]\nnode1 ansible_ssh_private_key_file=keys/lab\nnode2 ansible_ssh_private_key_file=~/.ssh/lab\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := Load(inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := inv.Hosts("k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{
+		{Name: "node1", Address: "node1", IdentityFile: filepath.Join(dir, "keys", "lab")},
+		{Name: "node2", Address: "node2", IdentityFile: "~/.ssh/lab"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Hosts() got = %v, want %v", got, want)
+	}
+}
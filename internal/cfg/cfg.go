@@ -22,19 +22,99 @@ import (
 	"io/ioutil"
 )
 
+// Secret points to a value that should not be stored in the config file.
+// The first one configured (Env, File, Command) is used.
+type Secret struct {
+	Env     string `yaml:"env,omitempty"`
+	File    string `yaml:"file,omitempty"`
+	Command string `yaml:"command,omitempty"`
+}
+
 type Source struct {
-	Source        string `yaml:"source"`
-	Insecure      bool   `yaml:"insecure"`
-	ApiAddress    string `yaml:"apiaddress"`
-	AutodetectApi bool   `yaml:"-"`
-	OverrideIp    string `yaml:"-"`
-	OverridePort  string `yaml:"-"`
+	Source        string   `yaml:"source"`
+	Insecure      bool     `yaml:"insecure"`
+	ApiAddress    string   `yaml:"apiaddress"`
+	Command       string   `yaml:"command,omitempty"`
+	Timeout       string   `yaml:"timeout,omitempty"`
+	Env           []string `yaml:"env,omitempty"`
+	Dir           string   `yaml:"dir,omitempty"`
+	Token         *Secret  `yaml:"token,omitempty"`
+	Username      string   `yaml:"username,omitempty"`
+	Password      *Secret  `yaml:"password,omitempty"`
+	CaFile        string   `yaml:"cafile,omitempty"`
+	MaxRedirects  int      `yaml:"maxredirects,omitempty"`
+	Sha256        string   `yaml:"sha256,omitempty"`
+	Kubeconfig    string   `yaml:"kubeconfig,omitempty"`
+	LabelTemplate string   `yaml:"labeltemplate,omitempty"`
+	User          string   `yaml:"user,omitempty"`
+	Port          int      `yaml:"port,omitempty"`
+	IdentityFile  string   `yaml:"identityfile,omitempty"`
+	SshPassword   *Secret  `yaml:"sshpassword,omitempty"`
+	HostKeyPolicy string   `yaml:"hostkeypolicy,omitempty"`
+	Passphrase    *Secret  `yaml:"passphrase,omitempty"`
+	Jump          string   `yaml:"jump,omitempty"`
+	Sudo          bool     `yaml:"sudo,omitempty"`
+	SudoPassword  *Secret  `yaml:"sudopassword,omitempty"`
+	Transports    []string `yaml:"transports,omitempty"`
+	Profile       string   `yaml:"profile,omitempty"`
+	AllContexts   bool     `yaml:"allcontexts,omitempty"`
+	Contexts      []string `yaml:"contexts,omitempty"`
+	ContextRegex  string   `yaml:"contextregex,omitempty"`
+	Naming        *Naming  `yaml:"naming,omitempty"`
+	Conflict      string   `yaml:"conflict,omitempty"`
+	Dedup         bool     `yaml:"dedup,omitempty"`
+	Rewrite       []Rule   `yaml:"rewrite,omitempty"`
+	AutodetectApi bool     `yaml:"-"`
+	OverrideIp    string   `yaml:"-"`
+	OverridePort  string   `yaml:"-"`
+	CopyId        bool     `yaml:"-"`
 }
 
 type Cfg struct {
 	Sources           map[string]Source `yaml:"sources"`
 	Destination       string            `yaml:"destination"`
 	DefaultSourcePath string
+	ControlMaster     bool        `yaml:"controlmaster,omitempty"`
+	ProbePaths        []ProbePath `yaml:"probepaths,omitempty"`
+	Naming            *Naming     `yaml:"naming,omitempty"`
+	Conflict          string      `yaml:"conflict,omitempty"`
+	Dedup             bool        `yaml:"dedup,omitempty"`
+	Rewrite           []Rule      `yaml:"rewrite,omitempty"`
+}
+
+// Naming holds the go templates of the names given to merged contexts, clusters and users.
+// Empty templates fall back to the global setting, then to "<original name>@<label>".
+type Naming struct {
+	Context string `yaml:"context,omitempty"`
+	Cluster string `yaml:"cluster,omitempty"`
+	User    string `yaml:"user,omitempty"`
+}
+
+// Rule rewrites the kube configuration of the sources it matches before they are merged.
+// Label, Host and Distribution are regular expressions, empty ones match every source.
+// The actions run in the order: Server, Set, Unset, Drop, Rename.
+type Rule struct {
+	Name         string            `yaml:"name,omitempty"`
+	Label        string            `yaml:"label,omitempty"`
+	Host         string            `yaml:"host,omitempty"`
+	Distribution string            `yaml:"distribution,omitempty"`
+	Server       *Replace          `yaml:"server,omitempty"`
+	Set          map[string]string `yaml:"set,omitempty"`
+	Unset        []string          `yaml:"unset,omitempty"`
+	Drop         []string          `yaml:"drop,omitempty"`
+	Rename       map[string]string `yaml:"rename,omitempty"`
+}
+
+// Replace is a regular expression replacement, Replace may use $1 style references.
+type Replace struct {
+	Regex   string `yaml:"regex"`
+	Replace string `yaml:"replace"`
+}
+
+// ProbePath is a kube configuration location tried on ssh hosts when the source has no path.
+type ProbePath struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
 }
 
 func Add(config *Cfg, label string, source Source) error {
@@ -57,7 +137,7 @@ func Save(config *Cfg) error {
 		return fmt.Errorf("unable marshal the config file: %v", err)
 	}
 
-	err = ioutil.WriteFile(viper.ConfigFileUsed(), configBytes, 600)
+	err = ioutil.WriteFile(viper.ConfigFileUsed(), configBytes, 0600)
 	if err != nil {
 		return fmt.Errorf("unable write the config file %s: %v", viper.ConfigFileUsed(), err)
 	}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"fmt"
+	"github.com/stefan-kiss/khg/internal/ansible"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var AnsibleProtocol = "ansible-inventory://"
+
+// AnsibleRef is what an ansible-inventory://<inventory>?group=<group>&path=<kubeconfig path> source points to.
+type AnsibleRef struct {
+	Inventory string
+	Group     string
+	// Path is the path of the kubeconfig on the hosts, the known locations are probed when empty
+	Path string
+}
+
+// ParseAnsibleUrl returns the inventory, group and path of an ansible-inventory source.
+// The inventory can be absolute (ansible-inventory:///etc/ansible/hosts), in the home (ansible-inventory://~/inventory.ini)
+// or relative to the current directory (ansible-inventory://inventory.ini).
+func ParseAnsibleUrl(u *url.URL) (AnsibleRef, error) {
+	ref := AnsibleRef{
+		Group: u.Query().Get("group"),
+		Path:  u.Query().Get("path"),
+	}
+	var err error
+	ref.Inventory, err = urlFile(u)
+	if err != nil {
+		return ref, err
+	}
+	if ref.Path != "" && !strings.HasPrefix(ref.Path, "/") && !strings.HasPrefix(ref.Path, "~/") {
+		return ref, fmt.Errorf("the kubeconfig path has to be absolute or start with ~/: %q", ref.Path)
+	}
+	return ref, nil
+}
+
+// AnsibleSources returns a ssh source for every host of the group, with the user, port and identity file
+// from the inventory. Settings of src are kept when the inventory has none.
+func AnsibleSources(ref AnsibleRef, src cfg.Source) ([]ansible.Host, []cfg.Source, error) {
+	inv, err := ansible.Load(ref.Inventory)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts, err := inv.Hosts(ref.Group)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sources := make([]cfg.Source, 0, len(hosts))
+	for _, h := range hosts {
+		s := src
+		s.LabelTemplate = ""
+		u := url.URL{Scheme: "ssh", Host: h.Address}
+		if strings.Contains(h.Address, ":") {
+			// ipv6
+			u.Host = "[" + h.Address + "]"
+		}
+		if strings.HasPrefix(ref.Path, "~/") {
+			u.Path = path.Join("/~", ref.Path[1:])
+		} else {
+			u.Path = ref.Path
+		}
+		s.Source = u.String()
+		if h.User != "" {
+			s.User = h.User
+		}
+		if h.Port != 0 {
+			s.Port = h.Port
+		}
+		if h.IdentityFile != "" {
+			s.IdentityFile = h.IdentityFile
+		}
+		sources = append(sources, s)
+	}
+	return hosts, sources, nil
+}
+
+// expandAnsible returns a source for every host of the inventory group, read again on every gather.
+func expandAnsible(u *url.URL, src cfg.Source) ([]Expanded, error) {
+	ref, err := ParseAnsibleUrl(u)
+	if err != nil {
+		return nil, err
+	}
+	hosts, sources, err := AnsibleSources(ref, src)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := make([]Expanded, 0, len(sources))
+	for i, s := range sources {
+		e, err := expandHostSource(s, hosts[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e...)
+	}
+	return expanded, nil
+}
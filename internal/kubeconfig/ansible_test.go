@@ -0,0 +1,133 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"github.com/mitchellh/go-homedir"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseAnsibleUrl(t *testing.T) {
+	home, err := homedir.Dir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		source  string
+		want    AnsibleRef
+		wantErr bool
+	}{
+		{
+			name:   "Absolute",
+			source: "ansible-inventory:///etc/ansible/hosts?group=k8s&path=/etc/kubernetes/admin.conf",
+			want:   AnsibleRef{Inventory: "/etc/ansible/hosts", Group: "k8s", Path: "/etc/kubernetes/admin.conf"},
+		},
+		{
+			name:   "Home",
+			source: "ansible-inventory://~/infra/inventory.yaml",
+			want:   AnsibleRef{Inventory: filepath.Join(home, "infra/inventory.yaml")},
+		},
+		{
+			name:   "Relative",
+			source: "ansible-inventory://inventory.ini?group=k8s",
+			want:   AnsibleRef{Inventory: "inventory.ini", Group: "k8s"},
+		},
+		{
+			name:    "RelativePath",
+			source:  "ansible-inventory:///etc/ansible/hosts?path=admin.conf",
+			wantErr: true,
+		},
+		{
+			name:    "NoInventory",
+			source:  "ansible-inventory://",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseAnsibleUrl(u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAnsibleUrl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAnsibleUrl() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandAnsible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "khg-ansible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inventory := filepath.Join(dir, "inventory.ini")
+	err = ioutil.WriteFile(inventory, []byte(`
+[k8s_masters]
+master1 ansible_host=10.0.0.1 ansible_user=centos ansible_port=2222 ansible_ssh_private_key_file=~/.ssh/lab
+master2 ansible_host=fd00::2
+
+[k8s_workers]
+worker1
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := "ansible-inventory://" + filepath.ToSlash(inventory) + "?group=k8s_masters&path=~/.kube/config"
+
+	got, err := Expand("lab", cfg.Source{Source: source, User: "ubuntu", Sudo: true})
+	if err != nil {
+		t.Fatalf("Expand() error = %v", err)
+	}
+	want := []Expanded{
+		{
+			Label:  "lab-master1",
+			Group:  "lab",
+			Source: cfg.Source{Source: "ssh://10.0.0.1/~/.kube/config", User: "centos", Port: 2222, IdentityFile: "~/.ssh/lab", Sudo: true},
+			Match:  "master1",
+			Host:   "10.0.0.1",
+		},
+		{
+			Label:  "lab-master2",
+			Group:  "lab",
+			Source: cfg.Source{Source: "ssh://[fd00::2]/~/.kube/config", User: "ubuntu", Sudo: true},
+			Match:  "master2",
+			Host:   "fd00::2",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expand() got = %v, want %v", got, want)
+	}
+
+	if label := ExpandingLabel(cfg.Source{Source: source}); label != "k8s_masters" {
+		t.Errorf("ExpandingLabel() = %v, want k8s_masters", label)
+	}
+	if !IsExpanding(cfg.Source{Source: source}) {
+		t.Errorf("IsExpanding() = false, want true")
+	}
+}
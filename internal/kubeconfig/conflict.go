@@ -0,0 +1,280 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Conflict policies, what happens when a merged name is already used in the destination.
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	ConflictFail      = "fail"
+	ConflictRename    = "rename"
+)
+
+// ConflictPolicies are the valid values of the conflict setting. The first one is the default.
+var ConflictPolicies = []string{ConflictOverwrite, ConflictSkip, ConflictFail, ConflictRename}
+
+// Conflict is a name already used in the destination, or a duplicate cluster or user, found while merging.
+type Conflict struct {
+	// Kind is context, cluster or user
+	Kind string
+	Name string
+	// Label being merged
+	Label string
+	// Owner is the label of the existing entry, empty when khg did not write it
+	Owner  string
+	Action string
+}
+
+// entries are the context, cluster and user of a source context, ready to be merged.
+type entries struct {
+	context     *clientcmdapi.Context
+	cluster     *clientcmdapi.Cluster
+	user        *clientcmdapi.AuthInfo
+	contextName string
+	clusterName string
+	userName    string
+	// names in the source
+	sourceContext string
+	sourceCluster string
+	sourceUser    string
+}
+
+// CheckConflict returns an error for unknown conflict policies.
+func CheckConflict(policy string) error {
+	if policy == "" {
+		return nil
+	}
+	for _, p := range ConflictPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict policy: %q, valid policies: %s", policy, strings.Join(ConflictPolicies, ", "))
+}
+
+// conflictPolicy returns the conflict policy of the source, else the global one.
+func conflictPolicy(src cfg.Source) (string, error) {
+	policy := src.Conflict
+	if policy == "" {
+		policy = viper.GetString("conflict")
+	}
+	if policy == "" {
+		policy = ConflictOverwrite
+	}
+	return policy, CheckConflict(policy)
+}
+
+// sameCluster reports whether both clusters are the same api server, trusted the same way.
+func sameCluster(a *clientcmdapi.Cluster, b *clientcmdapi.Cluster) bool {
+	return a.Server == b.Server &&
+		a.CertificateAuthority == b.CertificateAuthority &&
+		reflect.DeepEqual(a.CertificateAuthorityData, b.CertificateAuthorityData) &&
+		a.InsecureSkipTLSVerify == b.InsecureSkipTLSVerify &&
+		a.TLSServerName == b.TLSServerName &&
+		a.ProxyURL == b.ProxyURL
+}
+
+// sameUser reports whether both users hold the same credentials.
+func sameUser(a *clientcmdapi.AuthInfo, b *clientcmdapi.AuthInfo) bool {
+	a, b = a.DeepCopy(), b.DeepCopy()
+	for _, u := range []*clientcmdapi.AuthInfo{a, b} {
+		u.LocationOfOrigin = ""
+		u.Extensions = nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// duplicateCluster returns another cluster of the destination identical to the cluster.
+func (k *KubeConfig) duplicateCluster(name string, cluster *clientcmdapi.Cluster) (string, bool) {
+	for _, other := range k.clusterNames() {
+		if other != name && sameCluster(k.Config.Clusters[other], cluster) {
+			return other, true
+		}
+	}
+	return "", false
+}
+
+// duplicateUser returns another user of the destination identical to the user.
+func (k *KubeConfig) duplicateUser(name string, user *clientcmdapi.AuthInfo) (string, bool) {
+	for _, other := range k.userNames() {
+		if other != name && sameUser(k.Config.AuthInfos[other], user) {
+			return other, true
+		}
+	}
+	return "", false
+}
+
+func (k *KubeConfig) clusterNames() []string {
+	names := make([]string, 0, len(k.Config.Clusters))
+	for name := range k.Config.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (k *KubeConfig) userNames() []string {
+	names := make([]string, 0, len(k.Config.AuthInfos))
+	for name := range k.Config.AuthInfos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ownerLabel returns the label recorded in the extensions, "" for entries khg did not write.
+func ownerLabel(extensions map[string]runtime.Object) string {
+	o, _ := ownerOf(extensions)
+	return o.Label
+}
+
+// freeName returns the name with the first "-<n>" suffix no entry uses.
+func freeName(name string, used func(string) bool) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", name, i)
+		if !used(candidate) {
+			return candidate
+		}
+	}
+}
+
+// mergeEntries adds the entries to the destination following the conflict policy of the source and returns the
+// name of the merged context, empty when it was skipped. Conflicts and duplicates are added to k.Conflicts.
+func (k *KubeConfig) mergeEntries(label string, e entries, src cfg.Source) (string, error) {
+	policy, err := conflictPolicy(src)
+	if err != nil {
+		return "", err
+	}
+	if k.written == nil {
+		k.written = make(map[string]string)
+	}
+	dedup := src.Dedup || viper.GetBool("dedup")
+
+	// duplicates are looked for first, a deduplicated entry is not added so its name can not conflict
+	addCluster, addUser := true, true
+	if other, ok := k.duplicateCluster(e.clusterName, e.cluster); ok {
+		c := Conflict{Kind: "cluster", Name: e.clusterName, Label: label, Owner: ownerLabel(k.Config.Clusters[other].Extensions), Action: "duplicate of " + other}
+		if dedup {
+			c.Action = "deduplicated, using " + other
+			e.clusterName = other
+			addCluster = false
+		}
+		k.Conflicts = append(k.Conflicts, c)
+	}
+	if other, ok := k.duplicateUser(e.userName, e.user); ok {
+		c := Conflict{Kind: "user", Name: e.userName, Label: label, Owner: ownerLabel(k.Config.AuthInfos[other].Extensions), Action: "duplicate of " + other}
+		if dedup {
+			c.Action = "deduplicated, using " + other
+			e.userName = other
+			addUser = false
+		}
+		k.Conflicts = append(k.Conflicts, c)
+	}
+
+	names := []struct {
+		kind   string
+		name   *string
+		source string
+		add    bool
+		owner  func(string) (string, bool)
+	}{
+		{"context", &e.contextName, e.sourceContext, true, func(n string) (string, bool) {
+			c, ok := k.Config.Contexts[n]
+			if !ok {
+				return "", false
+			}
+			return ownerLabel(c.Extensions), true
+		}},
+		{"cluster", &e.clusterName, e.sourceCluster, addCluster, func(n string) (string, bool) {
+			c, ok := k.Config.Clusters[n]
+			if !ok {
+				return "", false
+			}
+			return ownerLabel(c.Extensions), true
+		}},
+		{"user", &e.userName, e.sourceUser, addUser, func(n string) (string, bool) {
+			u, ok := k.Config.AuthInfos[n]
+			if !ok {
+				return "", false
+			}
+			return ownerLabel(u.Extensions), true
+		}},
+	}
+	conflicts := make([]Conflict, 0)
+	for _, n := range names {
+		if !n.add {
+			continue
+		}
+		owner, exists := n.owner(*n.name)
+		if !exists {
+			continue
+		}
+		// entries of the label are replaced, unless another entry of the same source was just merged with the name
+		if written, ok := k.written[n.kind+"/"+*n.name]; owner == label && (!ok || written == n.source) {
+			continue
+		}
+		c := Conflict{Kind: n.kind, Name: *n.name, Label: label, Owner: owner}
+		switch policy {
+		case ConflictOverwrite:
+			c.Action = "overwritten"
+		case ConflictSkip:
+			c.Action = "skipped"
+		case ConflictFail:
+			c.Action = "failed"
+		case ConflictRename:
+			owner := n.owner
+			*n.name = freeName(*n.name, func(candidate string) bool {
+				_, used := owner(candidate)
+				return used
+			})
+			c.Action = "renamed to " + *n.name
+		}
+		conflicts = append(conflicts, c)
+	}
+	k.Conflicts = append(k.Conflicts, conflicts...)
+	if len(conflicts) > 0 && policy == ConflictFail {
+		c := conflicts[0]
+		return "", fmt.Errorf("%s %q is already used (owner: %q), conflict policy: %s", c.Kind, c.Name, c.Owner, policy)
+	}
+	if len(conflicts) > 0 && policy == ConflictSkip {
+		return "", nil
+	}
+
+	e.context.Cluster = e.clusterName
+	e.context.AuthInfo = e.userName
+	k.Config.Contexts[e.contextName] = e.context
+	k.written["context/"+e.contextName] = e.sourceContext
+	if addCluster {
+		k.Config.Clusters[e.clusterName] = e.cluster
+		k.written["cluster/"+e.clusterName] = e.sourceCluster
+	}
+	if addUser {
+		k.Config.AuthInfos[e.userName] = e.user
+		k.written["user/"+e.userName] = e.sourceUser
+	}
+	return e.contextName, nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCopyContexts_Conflicts(t *testing.T) {
+	defer viper.Set("conflict", "")
+	// a context written by hand with the name the source gets, and another source with the same cluster and user
+	dest := func() *KubeConfig {
+		k := &KubeConfig{Config: testDistConfig("default@lab", "default@lab", "default@lab", "https://10.0.0.9:6443")}
+		other := &KubeConfig{Config: testDistConfig("admin", "admin", "admin", "https://10.0.0.1:6443"), Label: "other"}
+		err := k.CopyContexts(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.Config.CurrentContext = "default@lab"
+		k.Conflicts = nil
+		return k
+	}
+
+	tests := []struct {
+		name          string
+		global        string
+		src           cfg.Source
+		wantContexts  []string
+		wantClusters  []string
+		wantConflicts []Conflict
+		wantErr       bool
+	}{
+		{
+			name:         "Overwrite",
+			wantContexts: []string{"admin@other", "default@lab"},
+			wantClusters: []string{"admin@other", "default@lab"},
+			wantConflicts: []Conflict{
+				{Kind: "cluster", Name: "default@lab", Label: "lab", Owner: "other", Action: "duplicate of admin@other"},
+				{Kind: "user", Name: "default@lab", Label: "lab", Owner: "other", Action: "duplicate of admin@other"},
+				{Kind: "context", Name: "default@lab", Label: "lab", Action: "overwritten"},
+				{Kind: "cluster", Name: "default@lab", Label: "lab", Action: "overwritten"},
+				{Kind: "user", Name: "default@lab", Label: "lab", Action: "overwritten"},
+			},
+		},
+		{
+			name:         "Skip",
+			global:       ConflictSkip,
+			wantContexts: []string{"admin@other", "default@lab"},
+			wantClusters: []string{"admin@other", "default@lab"},
+			wantConflicts: []Conflict{
+				{Kind: "cluster", Name: "default@lab", Label: "lab", Owner: "other", Action: "duplicate of admin@other"},
+				{Kind: "user", Name: "default@lab", Label: "lab", Owner: "other", Action: "duplicate of admin@other"},
+				{Kind: "context", Name: "default@lab", Label: "lab", Action: "skipped"},
+				{Kind: "cluster", Name: "default@lab", Label: "lab", Action: "skipped"},
+				{Kind: "user", Name: "default@lab", Label: "lab", Action: "skipped"},
+			},
+		},
+		{
+			name:    "Fail",
+			src:     cfg.Source{Conflict: ConflictFail},
+			wantErr: true,
+		},
+		{
+			name:         "Rename",
+			global:       ConflictFail,
+			src:          cfg.Source{Conflict: ConflictRename},
+			wantContexts: []string{"admin@other", "default@lab", "default@lab-2"},
+			wantClusters: []string{"admin@other", "default@lab", "default@lab-2"},
+			wantConflicts: []Conflict{
+				{Kind: "cluster", Name: "default@lab", Label: "lab", Owner: "other", Action: "duplicate of admin@other"},
+				{Kind: "user", Name: "default@lab", Label: "lab", Owner: "other", Action: "duplicate of admin@other"},
+				{Kind: "context", Name: "default@lab", Label: "lab", Action: "renamed to default@lab-2"},
+				{Kind: "cluster", Name: "default@lab", Label: "lab", Action: "renamed to default@lab-2"},
+				{Kind: "user", Name: "default@lab", Label: "lab", Action: "renamed to default@lab-2"},
+			},
+		},
+		{
+			name:         "RenameDedup",
+			src:          cfg.Source{Conflict: ConflictRename, Dedup: true},
+			wantContexts: []string{"admin@other", "default@lab", "default@lab-2"},
+			wantClusters: []string{"admin@other", "default@lab"},
+			wantConflicts: []Conflict{
+				{Kind: "cluster", Name: "default@lab", Label: "lab", Owner: "other", Action: "deduplicated, using admin@other"},
+				{Kind: "user", Name: "default@lab", Label: "lab", Owner: "other", Action: "deduplicated, using admin@other"},
+				{Kind: "context", Name: "default@lab", Label: "lab", Action: "renamed to default@lab-2"},
+			},
+		},
+		{
+			name:    "Invalid",
+			src:     cfg.Source{Conflict: "merge"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("conflict", tt.global)
+			k := dest()
+			from := &KubeConfig{Config: testDistConfig("default", "default", "default", "https://10.0.0.1:6443"), Label: "lab", SrcDef: tt.src}
+			err := k.CopyContexts(from)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CopyContexts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			contexts := k.contextNames()
+			clusters := k.clusterNames()
+			if !reflect.DeepEqual(contexts, tt.wantContexts) || !reflect.DeepEqual(clusters, tt.wantClusters) {
+				t.Errorf("CopyContexts() contexts = %v, clusters = %v, want %v, %v", contexts, clusters, tt.wantContexts, tt.wantClusters)
+			}
+			if !reflect.DeepEqual(k.Conflicts, tt.wantConflicts) {
+				t.Errorf("CopyContexts() conflicts = %+v, want %+v", k.Conflicts, tt.wantConflicts)
+			}
+			for name, context := range k.Config.Contexts {
+				if k.Config.Clusters[context.Cluster] == nil || k.Config.AuthInfos[context.AuthInfo] == nil {
+					t.Errorf("CopyContexts() context %q points to missing entries: %v", name, context)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyContexts_SharedEntries(t *testing.T) {
+	from := &KubeConfig{Config: testDistConfig("prod-admin", "prod", "admin", "https://prod.example.com:6443"), Label: "ext", SrcDef: cfg.Source{AllContexts: true}}
+	from.Config.Contexts["prod-ops"] = &clientcmdapi.Context{Cluster: "prod", AuthInfo: "admin"}
+	from.Config.Contexts["prod-view"] = &clientcmdapi.Context{Cluster: "prod", AuthInfo: "viewer"}
+	from.Config.AuthInfos["viewer"] = &clientcmdapi.AuthInfo{Token: "view"}
+
+	k := &KubeConfig{Config: *clientcmdapi.NewConfig()}
+	for i := 0; i < 2; i++ {
+		err := k.CopyContexts(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(k.Conflicts) != 0 {
+		t.Errorf("CopyContexts() conflicts = %+v, want none", k.Conflicts)
+	}
+
+	// a naming template giving every context the same name
+	from.SrcDef.Naming = &cfg.Naming{Context: "{{.Label}}"}
+	from.SrcDef.Conflict = ConflictRename
+	err := k.CopyContexts(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := k.contextNames()
+	sort.Strings(got)
+	if want := []string{"ext", "ext-2", "ext-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CopyContexts() contexts = %v, want %v", got, want)
+	}
+}
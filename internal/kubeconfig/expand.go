@@ -0,0 +1,386 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/kubesecret"
+	"github.com/stefan-kiss/khg/internal/kubesftp"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var (
+	CapiProtocol = "capi://"
+
+	// DefaultLabelTemplate names the sources an expanding source stands for.
+	// Removed sources are only detected when the template starts with "{{.Label}}-".
+	DefaultLabelTemplate = "{{.Label}}-{{.Match}}"
+
+	// MaxParallel is how many expanded sources are read at the same time.
+	MaxParallel = 8
+)
+
+// Expanded is one of the sources an expanding source stands for.
+type Expanded struct {
+	Label  string
+	Source cfg.Source
+	// Group is the label of the expanding source
+	Group string
+	// used to render the label
+	Match     string
+	Namespace string
+	Name      string
+	Host      string
+	Dir       string
+	File      string
+}
+
+// LabelData is what label templates can use.
+type LabelData struct {
+	// Label of the expanding source
+	Label string
+	// Match is what differs between the expanded sources
+	Match string
+	// Namespace and Name of Cluster API clusters
+	Namespace string
+	Name      string
+	// Host is the host the source is read from
+	Host string
+	// Dir is the name of the parent directory and File the file name without extension, for glob sources
+	Dir  string
+	File string
+}
+
+// IsExpanding reports whether the source stands for many sources, resolved on every gather.
+func IsExpanding(src cfg.Source) bool {
+	source := normalizeSource(src.Source)
+	if strings.HasPrefix(source, CapiProtocol) || strings.HasPrefix(source, AnsibleProtocol) || hasHostRange(source) {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return isGlobSource(u, src)
+}
+
+// isGlobSource reports whether the file or ssh source path is a glob or a directory (ends with "/").
+// "?" starts the query in urls, it has to be written as %3F.
+func isGlobSource(u *url.URL, src cfg.Source) bool {
+	if (u.Scheme != "ssh" && u.Scheme != "file" && u.Scheme != "") || src.Command != "" {
+		return false
+	}
+	return strings.ContainsAny(u.Path, "*?[") || (strings.HasSuffix(u.Path, "/") && u.Path != "/")
+}
+
+// ExpandingLabel is the label used for an expanding source when none is given: the host of ssh sources,
+// without its ranges, or the group (else the inventory name) of ansible-inventory sources.
+func ExpandingLabel(src cfg.Source) string {
+	source := normalizeSource(src.Source)
+	if hasHostRange(source) {
+		return rangeLabel(source)
+	}
+	if strings.HasPrefix(source, AnsibleProtocol) {
+		u, err := url.Parse(source)
+		if err != nil {
+			return ""
+		}
+		ref, err := ParseAnsibleUrl(u)
+		if err != nil {
+			return ""
+		}
+		if ref.Group != "" {
+			return ref.Group
+		}
+		return strings.TrimSuffix(filepath.Base(ref.Inventory), filepath.Ext(ref.Inventory))
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme != "ssh" {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Expand returns the sources an expanding source currently stands for.
+func Expand(label string, src cfg.Source) ([]Expanded, error) {
+	src.Source = normalizeSource(src.Source)
+	var expanded []Expanded
+	var u *url.URL
+	var err error
+	if !hasHostRange(src.Source) {
+		// hosts with ranges are not valid urls
+		u, err = url.Parse(src.Source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case hasHostRange(src.Source):
+		expanded, err = expandHostRange(src)
+	case u.Scheme == "capi":
+		expanded, err = expandCapi(u, label, src)
+	case u.Scheme == "ansible-inventory":
+		expanded, err = expandAnsible(u, src)
+	case isGlobSource(u, src):
+		expanded, err = expandGlob(u, src)
+	default:
+		return nil, fmt.Errorf("source does not expand: %q", src.Source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = renderLabels(label, src.LabelTemplate, expanded)
+	if err != nil {
+		return nil, err
+	}
+	for i := range expanded {
+		expanded[i].Group = label
+	}
+	return expanded, nil
+}
+
+// renderLabels sets the label of every expanded source from the template. Labels have to be unique.
+func renderLabels(label string, labelTemplate string, expanded []Expanded) error {
+	if labelTemplate == "" {
+		labelTemplate = DefaultLabelTemplate
+	}
+	tmpl, err := template.New(label).Option("missingkey=error").Parse(labelTemplate)
+	if err != nil {
+		return fmt.Errorf("unable to parse label template: %q: %v", labelTemplate, err)
+	}
+
+	seen := make(map[string]string)
+	for i := range expanded {
+		data := LabelData{
+			Label:     label,
+			Match:     expanded[i].Match,
+			Namespace: expanded[i].Namespace,
+			Name:      expanded[i].Name,
+			Host:      expanded[i].Host,
+			Dir:       expanded[i].Dir,
+			File:      expanded[i].File,
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, data)
+		if err != nil {
+			return fmt.Errorf("unable to render label template: %q: %v", labelTemplate, err)
+		}
+		expanded[i].Label = buf.String()
+		if expanded[i].Label == "" {
+			return fmt.Errorf("label template %q gives an empty label for %q", labelTemplate, expanded[i].Match)
+		}
+		if other, ok := seen[expanded[i].Label]; ok {
+			return fmt.Errorf("label template %q gives the same label %q for %q and %q", labelTemplate, expanded[i].Label, other, expanded[i].Match)
+		}
+		seen[expanded[i].Label] = expanded[i].Match
+	}
+	return nil
+}
+
+// expandCapi returns a k8s-secret source for every workload cluster of the management cluster.
+func expandCapi(u *url.URL, label string, src cfg.Source) ([]Expanded, error) {
+	ref, err := kubesecret.ParseCapiUrl(u)
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := kubesecret.ListClusters(ref, src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover clusters of: %q: %v", label, err)
+	}
+
+	expanded := make([]Expanded, 0, len(clusters))
+	for _, c := range clusters {
+		s := src
+		s.Source = c.Source(ref.Context)
+		s.LabelTemplate = ""
+		expanded = append(expanded, Expanded{
+			Source:    s,
+			Match:     c.Namespace + "-" + c.Name,
+			Namespace: c.Namespace,
+			Name:      c.Name,
+		})
+	}
+	return expanded, nil
+}
+
+// expandGlob returns a source for every file matching the glob, or in the directory, locally or over sftp.
+func expandGlob(u *url.URL, src cfg.Source) ([]Expanded, error) {
+	var pattern string
+	var matches []string
+	var err error
+	dir := strings.HasSuffix(u.Path, "/")
+	if u.Scheme == "ssh" {
+		pattern = u.Path
+		matches, err = kubesftp.Glob(u, src)
+	} else {
+		pattern, err = localPath(u)
+		if err == nil {
+			matches, err = localGlob(pattern, dir)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	expanded := make([]Expanded, 0, len(matches))
+	for _, match := range matches {
+		s := src
+		s.LabelTemplate = ""
+		if u.Scheme == "ssh" {
+			matchUrl := *u
+			matchUrl.Path = match
+			if !path.IsAbs(match) {
+				// relative to the home directory, see remotePath
+				matchUrl.Path = "/~/" + match
+			}
+			s.Source = matchUrl.String()
+		} else {
+			abs, err := filepath.Abs(match)
+			if err != nil {
+				return nil, err
+			}
+			s.Source = FileProtocol + filepath.ToSlash(abs)
+		}
+
+		file := strings.TrimSuffix(path.Base(match), path.Ext(match))
+		e := Expanded{
+			Source: s,
+			Match:  globMatch(pattern, match),
+			Host:   u.Hostname(),
+			Dir:    path.Base(path.Dir(match)),
+			File:   file,
+		}
+		if dir || e.Match == "" {
+			e.Match = file
+		}
+		expanded = append(expanded, e)
+	}
+	return expanded, nil
+}
+
+func localGlob(pattern string, dir bool) ([]string, error) {
+	if !dir {
+		return filepath.Glob(pattern)
+	}
+	files, err := ioutil.ReadDir(pattern)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+			matches = append(matches, filepath.Join(pattern, f.Name()))
+		}
+	}
+	return matches, nil
+}
+
+// globMatch returns the parts of the path matched by the wildcard elements of the pattern, joined with "-".
+// For clusters/*/kubeconfig and clusters/dev/kubeconfig it is "dev".
+func globMatch(pattern string, match string) string {
+	patternParts := strings.Split(path.Clean(pattern), "/")
+	matchParts := strings.Split(path.Clean(match), "/")
+	// relative matches from sftp are missing the "~/" of the pattern
+	offset := len(patternParts) - len(matchParts)
+	if offset < 0 {
+		return ""
+	}
+
+	captured := make([]string, 0)
+	for i, part := range matchParts {
+		if strings.ContainsAny(patternParts[i+offset], "*?[") {
+			captured = append(captured, part)
+		}
+	}
+	return strings.Join(captured, "-")
+}
+
+// expandHostSource returns the source of one host found by an expanding source, or the files it matches
+// when its path is a glob.
+func expandHostSource(s cfg.Source, match string) ([]Expanded, error) {
+	u, err := url.Parse(s.Source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse expanded source: %q: %v", s.Source, err)
+	}
+	if !isGlobSource(u, s) {
+		return []Expanded{{Source: s, Match: match, Host: u.Hostname()}}, nil
+	}
+
+	files, err := expandGlob(u, s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand source: %q: %v", s.Source, err)
+	}
+	for i := range files {
+		files[i].Match = match + "-" + files[i].Match
+	}
+	return files, nil
+}
+
+// StaleContexts returns the contexts that were created from the expanding source but are no longer part of it.
+func (k *KubeConfig) StaleContexts(label string, expanded []Expanded) []string {
+	current := make(map[string]bool)
+	for _, e := range expanded {
+		current[e.Label] = true
+	}
+
+	stale := make([]string, 0)
+	for _, contextName := range k.OwnedContexts(label, true) {
+		if o, _ := k.ContextOwner(contextName); !current[o.Label] {
+			stale = append(stale, contextName)
+		}
+	}
+	return stale
+}
+
+// SourceInitAll reads the expanded sources, MaxParallel at a time. Konfigs and errors are in the order of
+// the expanded sources, the konfig of a source that can not be read is nil.
+func SourceInitAll(expanded []Expanded) ([]*KubeConfig, []error) {
+	konfigs := make([]*KubeConfig, len(expanded))
+	errs := make([]error, len(expanded))
+
+	parallel := MaxParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range expanded {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			konfigs[i], errs[i] = SourceInit(expanded[i].Source, expanded[i].Label)
+			if errs[i] == nil {
+				konfigs[i].Group = expanded[i].Group
+			}
+		}(i)
+	}
+	wg.Wait()
+	return konfigs, errs
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"io/ioutil"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRenderLabels(t *testing.T) {
+	capiClusters := func() []Expanded {
+		return []Expanded{
+			{Match: "default-prod", Namespace: "default", Name: "prod"},
+			{Match: "team-a-prod", Namespace: "team-a", Name: "prod"},
+		}
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "Default",
+			want: []string{"mgmt-default-prod", "mgmt-team-a-prod"},
+		},
+		{
+			name:     "NamespaceAndName",
+			template: "{{.Name}}.{{.Namespace}}",
+			want:     []string{"prod.default", "prod.team-a"},
+		},
+		{
+			name:     "Duplicate",
+			template: "{{.Label}}-{{.Name}}",
+			wantErr:  true,
+		},
+		{
+			name:     "Empty",
+			template: "{{if false}}x{{end}}",
+			wantErr:  true,
+		},
+		{
+			name:     "UnknownField",
+			template: "{{.Cluster}}",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expanded := capiClusters()
+			err := renderLabels("mgmt", tt.template, expanded)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("renderLabels() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make([]string, 0)
+			for _, e := range expanded {
+				got = append(got, e.Label)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("renderLabels() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeConfig_StaleContexts(t *testing.T) {
+	k := &KubeConfig{
+		Config: clientcmdapi.Config{
+			Contexts: map[string]*clientcmdapi.Context{
+				"admin@mgmt-default-prod": ownedContext(t, "mgmt-default-prod", "mgmt"),
+				"admin@mgmt-team-a-dev":   ownedContext(t, "mgmt-team-a-dev", "mgmt"),
+				"admin@mgmt":              ownedContext(t, "mgmt", ""),
+				"admin@mgmt-x":            ownedContext(t, "mgmt-x", ""),
+				"admin@other-team-a-dev":  ownedContext(t, "other-team-a-dev", "other"),
+				"admin@mgmt-by-hand":      {},
+			},
+		},
+	}
+	expanded := []Expanded{
+		{Label: "mgmt-default-prod", Source: cfg.Source{}},
+	}
+	got := k.StaleContexts("mgmt", expanded)
+	want := []string{"admin@mgmt-team-a-dev"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("StaleContexts() got = %v, want %v", got, want)
+	}
+}
+
+func TestIsExpanding(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{source: "capi:///?context=mgmt", want: true},
+		{source: "k8s-secret:///default/prod-kubeconfig", want: false},
+		{source: "ssh://10.0.0.1", want: false},
+		{source: "ssh://10.0.0.1/", want: false},
+		{source: "ssh://10.0.0.1/home/ci/clusters/*/kubeconfig", want: true},
+		{source: "ssh://10.0.0.1/home/ci/configs/", want: true},
+		{source: "10.0.0.1/~/configs/*.yaml", want: true},
+		{source: "file:///tmp/configs/", want: true},
+		{source: "file:///tmp/config", want: false},
+		{source: "exec://kind/get/kubeconfig", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := IsExpanding(cfg.Source{Source: tt.source}); got != tt.want {
+				t.Errorf("IsExpanding() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		match   string
+		want    string
+	}{
+		{name: "Dir", pattern: "/home/ci/clusters/*/kubeconfig", match: "/home/ci/clusters/dev/kubeconfig", want: "dev"},
+		{name: "File", pattern: "/etc/*.conf", match: "/etc/admin.conf", want: "admin.conf"},
+		{name: "Many", pattern: "/k/*/x/*", match: "/k/a/x/b", want: "a-b"},
+		{name: "Relative", pattern: "~/clusters/*/kubeconfig", match: "clusters/dev/kubeconfig", want: "dev"},
+		{name: "NoWildcard", pattern: "/etc/kubeconfig", match: "/etc/kubeconfig", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := globMatch(tt.pattern, tt.match); got != tt.want {
+				t.Errorf("globMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "khg-expand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"clusters/dev/kubeconfig", "clusters/prod/kubeconfig", "clusters/prod/.hidden", "configs/a.yaml", "configs/b.conf", "configs/.hidden"} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := "file://" + filepath.ToSlash(dir)
+
+	tests := []struct {
+		name     string
+		source   string
+		template string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			name:   "Glob",
+			source: root + "/clusters/*/kubeconfig",
+			want: map[string]string{
+				"ci-dev":  root + "/clusters/dev/kubeconfig",
+				"ci-prod": root + "/clusters/prod/kubeconfig",
+			},
+		},
+		{
+			name:   "Directory",
+			source: root + "/configs/",
+			want: map[string]string{
+				"ci-a": root + "/configs/a.yaml",
+				"ci-b": root + "/configs/b.conf",
+			},
+		},
+		{
+			name:     "Template",
+			source:   root + "/clusters/*/kubeconfig",
+			template: "{{.Dir}}-{{.File}}",
+			want: map[string]string{
+				"dev-kubeconfig":  root + "/clusters/dev/kubeconfig",
+				"prod-kubeconfig": root + "/clusters/prod/kubeconfig",
+			},
+		},
+		{
+			name:     "DuplicateLabels",
+			source:   root + "/clusters/*/kubeconfig",
+			template: "{{.File}}",
+			wantErr:  true,
+		},
+		{
+			name:    "MissingDirectory",
+			source:  root + "/missing/",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Expand("ci", cfg.Source{Source: tt.source, LabelTemplate: tt.template})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			sources := make(map[string]string)
+			for _, e := range got {
+				sources[e.Label] = e.Source.Source
+			}
+			if !reflect.DeepEqual(sources, tt.want) {
+				t.Errorf("Expand() got = %v, want %v", sources, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceInitAll(t *testing.T) {
+	src, err := filepath.Abs("../../test/kubeconfig/config.src.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded := []Expanded{
+		{Label: "a", Source: cfg.Source{Source: "file://" + filepath.ToSlash(src)}},
+		{Label: "missing", Source: cfg.Source{Source: "file://" + filepath.ToSlash(src) + ".missing"}},
+		{Label: "b", Source: cfg.Source{Source: "file://" + filepath.ToSlash(src)}},
+	}
+
+	defer func(parallel int) { MaxParallel = parallel }(MaxParallel)
+	MaxParallel = 2
+	konfigs, errs := SourceInitAll(expanded)
+	for i, e := range expanded {
+		if (errs[i] != nil) != (e.Label == "missing") {
+			t.Errorf("SourceInitAll() %s error = %v", e.Label, errs[i])
+		}
+		if errs[i] == nil && (konfigs[i] == nil || konfigs[i].Label != e.Label) {
+			t.Errorf("SourceInitAll() %s got = %v", e.Label, konfigs[i])
+		}
+	}
+}
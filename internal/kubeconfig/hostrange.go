@@ -0,0 +1,181 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"fmt"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// MaxRangeHosts limits how many hosts a host range expands to, a typo in a range should not dial the internet.
+	MaxRangeHosts = 1024
+
+	// hostRangePattern matches the ranges of a host: node[01-12,15] or {a,b,c}.
+	// The brackets of ipv6 addresses are not ranges, they hold colons.
+	hostRangePattern = regexp.MustCompile(`\[([0-9]+(?:-[0-9]+)?(?:,[0-9]+(?:-[0-9]+)?)*)\]|\{([^{}/]*,[^{}/]*)\}`)
+)
+
+// hostValue is one host a host range expands to.
+type hostValue struct {
+	host string
+	// the values taken from the ranges, joined with "-"
+	match string
+}
+
+// splitHost splits the source around its host (without the user and the port).
+func splitHost(source string) (prefix string, host string, rest string) {
+	i := strings.Index(source, "://")
+	if i < 0 {
+		return "", "", source
+	}
+	start := i + len("://")
+	end := len(source)
+	if j := strings.IndexAny(source[start:], "/?"); j >= 0 {
+		end = start + j
+	}
+	authority := source[start:end]
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		start += at + 1
+		authority = authority[at+1:]
+	}
+	// ports never follow a range, but ipv6 addresses hold colons
+	if colon := strings.LastIndex(authority, ":"); colon >= 0 && !strings.HasSuffix(authority, "]") {
+		if _, err := strconv.Atoi(authority[colon+1:]); err == nil {
+			end = start + colon
+		}
+	}
+	return source[:start], source[start:end], source[end:]
+}
+
+// hasHostRange reports whether the host of a ssh or http(s) source holds a range.
+func hasHostRange(source string) bool {
+	for _, protocol := range []string{SshProtocol, SshExecProtocol, HttpProtocol, HttpsProtocol} {
+		if strings.HasPrefix(source, protocol) {
+			_, host, _ := splitHost(source)
+			return hostRangePattern.MatchString(host)
+		}
+	}
+	return false
+}
+
+// rangeLabel is the host of a source with its ranges removed: node.lab for node[01-12].lab.
+func rangeLabel(source string) string {
+	_, host, _ := splitHost(source)
+	return strings.Trim(hostRangePattern.ReplaceAllString(host, ""), ".-")
+}
+
+// rangeValues returns the values of a numeric range: 01-03,7 gives 01, 02, 03 and 7.
+// A leading zero pads all the values to the width of the first one.
+func rangeValues(spec string) ([]string, error) {
+	values := make([]string, 0)
+	for _, item := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		if len(bounds) == 1 {
+			values = append(values, item)
+			continue
+		}
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range: %q: %v", item, err)
+		}
+		last, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range: %q: %v", item, err)
+		}
+		if last < first {
+			return nil, fmt.Errorf("invalid range: %q: %d is less than %d", item, last, first)
+		}
+		if last-first >= MaxRangeHosts {
+			return nil, fmt.Errorf("range %q has more than %d values", item, MaxRangeHosts)
+		}
+		width := 0
+		if len(bounds[0]) > 1 && strings.HasPrefix(bounds[0], "0") {
+			width = len(bounds[0])
+		}
+		for n := first; n <= last; n++ {
+			values = append(values, fmt.Sprintf("%0*d", width, n))
+		}
+	}
+	return values, nil
+}
+
+// expandHost returns every host a host pattern stands for, in order. Ranges combine: {a,b}[1-2] gives a1, a2, b1, b2.
+func expandHost(pattern string) ([]hostValue, error) {
+	hosts := []hostValue{{}}
+	last := 0
+	for _, loc := range hostRangePattern.FindAllStringSubmatchIndex(pattern, -1) {
+		var values []string
+		if loc[2] >= 0 {
+			var err error
+			values, err = rangeValues(pattern[loc[2]:loc[3]])
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			values = strings.Split(pattern[loc[4]:loc[5]], ",")
+		}
+		if len(hosts)*len(values) > MaxRangeHosts {
+			return nil, fmt.Errorf("host %q expands to more than %d hosts", pattern, MaxRangeHosts)
+		}
+
+		literal := pattern[last:loc[0]]
+		next := make([]hostValue, 0, len(hosts)*len(values))
+		for _, h := range hosts {
+			for _, v := range values {
+				match := v
+				if h.match != "" {
+					match = h.match + "-" + v
+				}
+				next = append(next, hostValue{host: h.host + literal + v, match: match})
+			}
+		}
+		hosts = next
+		last = loc[1]
+	}
+	for i := range hosts {
+		hosts[i].host += pattern[last:]
+		if hosts[i].host == "" {
+			return nil, fmt.Errorf("host %q expands to an empty host", pattern)
+		}
+	}
+	return hosts, nil
+}
+
+// expandHostRange returns a source for every host of the range. Sources that are globs themselves are expanded too.
+func expandHostRange(src cfg.Source) ([]Expanded, error) {
+	prefix, host, rest := splitHost(src.Source)
+	hosts, err := expandHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := make([]Expanded, 0, len(hosts))
+	for _, h := range hosts {
+		s := src
+		s.Source = prefix + h.host + rest
+		s.LabelTemplate = ""
+		e, err := expandHostSource(s, h.match)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e...)
+	}
+	return expanded, nil
+}
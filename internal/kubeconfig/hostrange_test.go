@@ -0,0 +1,176 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"reflect"
+	"testing"
+)
+
+func TestExpandHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    []hostValue
+		wantErr bool
+	}{
+		{
+			name:    "Range",
+			pattern: "node[1-3].lab",
+			want:    []hostValue{{"node1.lab", "1"}, {"node2.lab", "2"}, {"node3.lab", "3"}},
+		},
+		{
+			name:    "Padded",
+			pattern: "node[08-10]",
+			want:    []hostValue{{"node08", "08"}, {"node09", "09"}, {"node10", "10"}},
+		},
+		{
+			name:    "List",
+			pattern: "node[1,5-6]",
+			want:    []hostValue{{"node1", "1"}, {"node5", "5"}, {"node6", "6"}},
+		},
+		{
+			name:    "Braces",
+			pattern: "{a,b,c}.lab",
+			want:    []hostValue{{"a.lab", "a"}, {"b.lab", "b"}, {"c.lab", "c"}},
+		},
+		{
+			name:    "Combined",
+			pattern: "{web,db}[1-2]",
+			want:    []hostValue{{"web1", "web-1"}, {"web2", "web-2"}, {"db1", "db-1"}, {"db2", "db-2"}},
+		},
+		{
+			name:    "Reversed",
+			pattern: "node[3-1]",
+			wantErr: true,
+		},
+		{
+			name:    "TooMany",
+			pattern: "node[1-100000]",
+			wantErr: true,
+		},
+		{
+			name:    "Empty",
+			pattern: "{,}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandHost(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandHost() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasHostRange(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{source: "ssh://node[01-12].lab/etc/rancher/k3s/k3s.yaml", want: true},
+		{source: "ssh://root@{a,b,c}.lab:2222", want: true},
+		{source: "ssh+exec://node[1-2]?cmd=microk8s+config", want: true},
+		{source: "https://{dev,prod}.example.com/kubeconfig", want: true},
+		{source: "ssh://[::1]:2222/etc/kubeconfig", want: false},
+		{source: "ssh://node1.lab/clusters/[ab]/kubeconfig", want: false},
+		{source: "file:///tmp/{a,b}", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := hasHostRange(tt.source); got != tt.want {
+				t.Errorf("hasHostRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandHostRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		template string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			name:   "Default",
+			source: "centos@node[01-02].lab:2222/etc/rancher/k3s/k3s.yaml",
+			want: map[string]string{
+				"lab-01": "ssh://centos@node01.lab:2222/etc/rancher/k3s/k3s.yaml",
+				"lab-02": "ssh://centos@node02.lab:2222/etc/rancher/k3s/k3s.yaml",
+			},
+		},
+		{
+			name:     "Host",
+			source:   "ssh://{a,b}.lab",
+			template: "{{.Host}}",
+			want: map[string]string{
+				"a.lab": "ssh://a.lab",
+				"b.lab": "ssh://b.lab",
+			},
+		},
+		{
+			name:     "DuplicateLabels",
+			source:   "ssh://{a,b}.lab",
+			template: "{{.Label}}",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Expand("lab", cfg.Source{Source: tt.source, LabelTemplate: tt.template})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			sources := make(map[string]string)
+			for _, e := range got {
+				sources[e.Label] = e.Source.Source
+			}
+			if !reflect.DeepEqual(sources, tt.want) {
+				t.Errorf("Expand() got = %v, want %v", sources, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandingLabel(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{source: "ssh://node[01-12].lab/etc/rancher/k3s/k3s.yaml", want: "node.lab"},
+		{source: "{a,b,c}.lab", want: "lab"},
+		{source: "ci@build01/home/ci/clusters/*/kubeconfig", want: "build01"},
+		{source: "file:///tmp/configs/", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := ExpandingLabel(cfg.Source{Source: tt.source}); got != tt.want {
+				t.Errorf("ExpandingLabel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -21,7 +21,12 @@ import (
 	"github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/kubehttp"
+	"github.com/stefan-kiss/khg/internal/kubesecret"
 	"github.com/stefan-kiss/khg/internal/kubesftp"
+	"github.com/stefan-kiss/khg/internal/shell"
+	"github.com/stefan-kiss/khg/internal/tfstate"
+	"io"
 	"io/ioutil"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/clientcmd"
@@ -30,14 +35,29 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
 var (
-	SshProtocol  = "ssh://"
-	FileProtocol = "file://"
-	LocalHost    = "127.0.0.1"
+	SshProtocol     = "ssh://"
+	SshExecProtocol = "ssh+exec://"
+	FileProtocol    = "file://"
+	ExecProtocol    = "exec://"
+	HttpProtocol    = "http://"
+	HttpsProtocol   = "https://"
+	SecretProtocol  = "k8s-secret://"
+	TfstateProtocol = "tfstate://"
+	StdinProtocol   = "stdin://"
+	LocalHost       = "127.0.0.1"
+
+	// DefaultExecTimeout is used for local command sources without a timeout
+	DefaultExecTimeout = time.Minute
+
+	// Stdin is read by stdin:// sources
+	Stdin io.Reader = os.Stdin
 )
 
 type KubeConfig struct {
@@ -46,30 +66,160 @@ type KubeConfig struct {
 	Config clientcmdapi.Config
 	Label  string
 	SrcDef cfg.Source
+	// Distribution is the kubernetes distribution detected while probing the host, if any.
+	Distribution string
+	// Profile is the name of the distribution profile applied to the configuration, if any.
+	Profile string
+	// Group is the label of the expanding source the configuration was read for, if any.
+	Group string
+	// Fetched is when the configuration was read.
+	Fetched time.Time
+	// Conflicts found while merging into this configuration.
+	Conflicts []Conflict
+	// Changes made by the rewrite rules of the source.
+	Changes []Change
+	// written are the entries merged from the current source, with their names in the source.
+	written map[string]string
+}
+
+// localPath returns the file name from a local url, expanding "~/".
+// file://~/path parses with "~" as the host so it is put back in front of the path.
+func localPath(u *url.URL) (string, error) {
+	path := u.Path
+	if u.Host == "~" {
+		path = "~" + path
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", fmt.Errorf("unable to determine home for filename: %v :%v", path, err)
+		}
+		return filepath.Join(home, path[1:]), nil
+	}
+	return path, nil
+}
+
+// urlFile returns the local file named by a source url: absolute (tfstate:///srv/terraform.tfstate),
+// in the home (tfstate://~/infra/terraform.tfstate) or relative to the current directory (tfstate://terraform.tfstate).
+func urlFile(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "~" {
+		return u.Host + u.Path, nil
+	}
+	fileName, err := localPath(u)
+	if err != nil {
+		return "", err
+	}
+	if fileName == "" {
+		return "", fmt.Errorf("no file in source: %q", u.String())
+	}
+	return fileName, nil
+}
+
+// execCommand returns the command of a local command source and its timeout.
+func execCommand(u *url.URL, src cfg.Source) (string, time.Duration, error) {
+	command := src.Command
+	if command == "" {
+		command = u.Query().Get("cmd")
+	}
+	if command == "" {
+		return "", 0, fmt.Errorf("no command configured for source: %q", u.Redacted())
+	}
+
+	timeout := DefaultExecTimeout
+	if src.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(src.Timeout)
+		if err != nil {
+			return "", 0, fmt.Errorf("unable to parse timeout: %q: %v", src.Timeout, err)
+		}
+	}
+	return command, timeout, nil
 }
 
 func (k *KubeConfig) ReadConfig() (err error) {
 
 	var bContent []byte
 	var host string
-	if k.Url.Scheme == "ssh" {
+	if k.SrcDef.CopyId && (k.Url.Scheme == "ssh" || k.Url.Scheme == "ssh+exec") && !IsExpanding(k.SrcDef) {
+		err = kubesftp.CopyId(k.Url, k.SrcDef)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case IsExpanding(k.SrcDef):
+		return fmt.Errorf("source %q stands for many sources, it is read by gather", k.SrcDef.Source)
+	case k.Url.Scheme == "exec":
+		k.SrcDef.OverrideIp = LocalHost
+		command, timeout, err := execCommand(k.Url, k.SrcDef)
+		if err != nil {
+			return err
+		}
+		dir, err := localPath(&url.URL{Path: k.SrcDef.Dir})
+		if err != nil {
+			return err
+		}
+		log.Debugf("protocol: EXEC, COMMAND: %q, DIR: %q, TIMEOUT: %v", command, dir, timeout)
+		bContent, err = shell.Output(command, dir, k.SrcDef.Env, timeout)
+		if err != nil {
+			return err
+		}
+	case k.Url.Scheme == "ssh+exec" || (k.Url.Scheme == "ssh" && k.SrcDef.Command != ""):
+		log.Debugf("protocol: SSH EXEC, HOST: %q", k.Url.Host)
+		bContent, host, _, err = kubesftp.GetCommandOutput(k.Url, k.SrcDef)
+		k.SrcDef.OverrideIp = host
+		if err != nil {
+			return err
+		}
+	case k.Url.Scheme == "http" || k.Url.Scheme == "https":
+		log.Debugf("protocol: HTTP, HOST: %q", k.Url.Host)
+		k.SrcDef.OverrideIp = k.Url.Hostname()
+		bContent, err = kubehttp.GetFile(k.Url, k.SrcDef)
+		if err != nil {
+			return err
+		}
+	case k.Url.Scheme == "k8s-secret":
+		log.Debugf("protocol: K8S SECRET, PATH: %q", k.Url.Path)
+		bContent, host, err = kubesecret.GetFile(k.Url, k.SrcDef)
+		k.SrcDef.OverrideIp = host
+		if err != nil {
+			return err
+		}
+	case k.Url.Scheme == "stdin":
+		log.Debugf("protocol: STDIN")
+		bContent, err = ioutil.ReadAll(Stdin)
+		if err != nil {
+			return fmt.Errorf("unable to read stdin: %v", err)
+		}
+		if len(bContent) == 0 {
+			return fmt.Errorf("nothing to read on stdin")
+		}
+	case k.Url.Scheme == "tfstate":
+		fileName, err := urlFile(k.Url)
+		if err != nil {
+			return err
+		}
+		log.Debugf("protocol: TFSTATE, PATH: %q, OUTPUT: %q", fileName, k.Url.Query().Get("output"))
+		bContent, err = tfstate.GetOutput(fileName, k.Url.Query().Get("output"))
+		if err != nil {
+			return err
+		}
+	case k.Url.Scheme == "ssh":
 		log.Debugf("protocol: SSH, HOST: %q", k.Url.Host)
-		bContent, host, _, err = kubesftp.GetFile(k.Url)
+		if k.Url.Path == "" {
+			bContent, host, _, k.Distribution, err = kubesftp.ProbeFile(k.Url, k.SrcDef)
+		} else {
+			bContent, host, _, err = kubesftp.GetFile(k.Url, k.SrcDef)
+		}
 		k.SrcDef.OverrideIp = host
 		if err != nil {
 			return err
 		}
-	} else {
-		var fileName string
+	default:
 		k.SrcDef.OverrideIp = LocalHost
-		if strings.HasPrefix(k.Url.Path, "~/") {
-			home, err := homedir.Dir()
-			if err != nil {
-				return fmt.Errorf("unable to determine home for filename: %v :%v", k.Url.Path, err)
-			}
-			fileName = filepath.Join(home, k.Url.Path[2:])
-		} else {
-			fileName = k.Url.Path
+		fileName, err := localPath(k.Url)
+		if err != nil {
+			return err
 		}
 		log.Debugf("protocol: FILE, PATH: %q", fileName)
 		bContent, err = ioutil.ReadFile(fileName)
@@ -82,6 +232,8 @@ func (k *KubeConfig) ReadConfig() (err error) {
 	if err != nil {
 		return err
 	}
+	k.Bytes = bContent
+	k.Fetched = time.Now().UTC()
 	k.Config, err = clientConfig.RawConfig()
 	if err != nil {
 		return err
@@ -103,11 +255,39 @@ func DestInit(source string) (konf *KubeConfig, err error) {
 	return konf, nil
 }
 
+func hasProtocol(source string) bool {
+	for _, protocol := range []string{FileProtocol, SshProtocol, SshExecProtocol, ExecProtocol, HttpProtocol, HttpsProtocol, SecretProtocol, TfstateProtocol, StdinProtocol, CapiProtocol, AnsibleProtocol} {
+		if strings.HasPrefix(source, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalPath reports whether a source without a protocol is a local file rather than a host.
+func isLocalPath(source string) bool {
+	return strings.HasPrefix(source, "/") || strings.HasPrefix(source, "~/") || strings.HasPrefix(source, "./")
+}
+
+// IsStdin reports whether the source reads standard input ("-" or stdin://). It can not be read again later.
+func IsStdin(source string) bool {
+	return source == "-" || strings.HasPrefix(source, StdinProtocol)
+}
+
+// normalizeSource adds the ssh protocol to sources that are neither urls nor local paths.
+func normalizeSource(source string) string {
+	if source == "-" {
+		return StdinProtocol
+	}
+	if !hasProtocol(source) && !isLocalPath(source) {
+		return SshProtocol + source
+	}
+	return source
+}
+
 func SourceInit(source cfg.Source, label string) (konf *KubeConfig, err error) {
 	konf = new(KubeConfig)
-	if !strings.HasPrefix(source.Source, FileProtocol) && !strings.HasPrefix(source.Source, SshProtocol) {
-		source.Source = SshProtocol + source.Source
-	}
+	source.Source = normalizeSource(source.Source)
 	konf.Url, err = url.Parse(source.Source)
 	if err != nil {
 		return nil, err
@@ -117,12 +297,42 @@ func SourceInit(source cfg.Source, label string) (konf *KubeConfig, err error) {
 	log.Infof("using source: %s", source.Source)
 	err = konf.ReadConfig()
 	if err != nil {
-		return nil, fmt.Errorf("unable to read current destination config file: %v: %v", source, err)
+		return nil, fmt.Errorf("unable to read source: %v: %v", source.Source, err)
+	}
+	err = konf.ApplyProfile()
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply profile to source: %v: %v", source.Source, err)
+	}
+	// rules may match the label
+	if konf.Label == "" {
+		konf.Label = konf.DefaultLabel()
+	}
+	err = konf.Rewrite()
+	if err != nil {
+		return nil, fmt.Errorf("unable to rewrite source: %v: %v", source.Source, err)
 	}
 
 	return konf, nil
 }
 
+// DefaultLabel is the label used when none is given: the host, or the cluster name for k8s-secret sources.
+func (k *KubeConfig) DefaultLabel() string {
+	if k.Url.Scheme == "k8s-secret" {
+		if ref, err := kubesecret.ParseUrl(k.Url); err == nil {
+			return strings.TrimSuffix(ref.Name, "-kubeconfig")
+		}
+	}
+	if k.Url.Scheme == "tfstate" {
+		// the directory of the terraform root module
+		if fileName, err := urlFile(k.Url); err == nil {
+			if abs, err := filepath.Abs(fileName); err == nil {
+				return filepath.Base(filepath.Dir(abs))
+			}
+		}
+	}
+	return k.Url.Host
+}
+
 func (k *KubeConfig) WriteConfig() (err error) {
 
 	bContent, err := k.ToYaml()
@@ -130,18 +340,12 @@ func (k *KubeConfig) WriteConfig() (err error) {
 		return fmt.Errorf("WriteConfig unexpected error: %v", err)
 	}
 
-	var fileName string
-	if strings.HasPrefix(k.Url.Path, "~/") {
-		home, err := homedir.Dir()
-		if err != nil {
-			return fmt.Errorf("unable to determine home for filename: %v :%v", k.Url.Path, err)
-		}
-		fileName = filepath.Join(home, k.Url.Path[2:])
-	} else {
-		fileName = k.Url.Path
+	fileName, err := localPath(k.Url)
+	if err != nil {
+		return err
 	}
 
-	backupFileName := k.Url.Path + fmt.Sprintf(".%d", time.Now().Unix())
+	backupFileName := fileName + fmt.Sprintf(".%d", time.Now().Unix())
 	_ = os.Rename(fileName, backupFileName)
 	err = ioutil.WriteFile(fileName, bContent, 0600)
 	if err != nil {
@@ -170,7 +374,75 @@ func (k *KubeConfig) CopyCurrentContext(from *KubeConfig) error {
 	if kubeContextName == "" {
 		return fmt.Errorf("unable to find current context : %v", from.Config)
 	}
+	return k.copyContext(from, kubeContextName)
+}
 
+// CopyContexts copies the contexts selected by the source, or the current context when the source selects none.
+// The entries merged before with the same label are replaced.
+func (k *KubeConfig) CopyContexts(from *KubeConfig) error {
+	k.removeOwned(from.Label)
+	k.written = nil
+	if !from.SrcDef.AllContexts && len(from.SrcDef.Contexts) == 0 && from.SrcDef.ContextRegex == "" {
+		return k.CopyCurrentContext(from)
+	}
+	names, err := from.SelectContexts()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = k.copyContext(from, name)
+		if err != nil {
+			return fmt.Errorf("context %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// SelectContexts returns the names of the contexts selected by the source: all of them, the listed
+// names and the ones matching the regular expression. The current context comes first.
+func (k *KubeConfig) SelectContexts() ([]string, error) {
+	var re *regexp.Regexp
+	if k.SrcDef.ContextRegex != "" {
+		var err error
+		re, err = regexp.Compile(k.SrcDef.ContextRegex)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse context regex: %q: %v", k.SrcDef.ContextRegex, err)
+		}
+	}
+	listed := make(map[string]bool)
+	for _, name := range k.SrcDef.Contexts {
+		if _, ok := k.Config.Contexts[name]; !ok {
+			return nil, fmt.Errorf("context %q not found in source, contexts: %v", name, k.contextNames())
+		}
+		listed[name] = true
+	}
+
+	names := make([]string, 0)
+	for _, name := range k.contextNames() {
+		if k.SrcDef.AllContexts || listed[name] || (re != nil && re.MatchString(name)) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no context matches %q, contexts: %v", k.SrcDef.ContextRegex, k.contextNames())
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return names[i] == k.Config.CurrentContext && names[j] != k.Config.CurrentContext
+	})
+	return names, nil
+}
+
+func (k *KubeConfig) contextNames() []string {
+	names := make([]string, 0, len(k.Config.Contexts))
+	for name := range k.Config.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// copyContext copies a context with its cluster and user, named by the naming templates of the source.
+func (k *KubeConfig) copyContext(from *KubeConfig, kubeContextName string) error {
 	if _, ok := from.Config.Contexts[kubeContextName]; !ok {
 		return fmt.Errorf("unable to find context details: %v", from.Config)
 	}
@@ -192,47 +464,44 @@ func (k *KubeConfig) CopyCurrentContext(from *KubeConfig) error {
 		return fmt.Errorf("unable to find auth: %v", from.Config)
 	}
 
-	translatedContext := fmt.Sprintf("%s@%s", kubeContextName, from.Label)
-	translatedCluster := fmt.Sprintf("%s@%s", kubeContext.Cluster, from.Label)
-	translatedAuth := fmt.Sprintf("%s@%s", kubeContext.AuthInfo, from.Label)
-
-	k.Config.Clusters[translatedCluster] = from.Config.Clusters[kubeContext.Cluster]
-	k.Config.AuthInfos[translatedAuth] = from.Config.AuthInfos[kubeContext.AuthInfo]
-	k.Config.Contexts[translatedContext] = from.Config.Contexts[kubeContextName]
-
-	k.Config.Contexts[translatedContext].Cluster = translatedCluster
-	k.Config.Contexts[translatedContext].AuthInfo = translatedAuth
-
-	if !from.SrcDef.AutodetectApi && from.SrcDef.ApiAddress != "" {
-		k.Config.Clusters[translatedCluster].Server = from.SrcDef.ApiAddress
+	naming, err := SourceNaming(from.SrcDef)
+	if err != nil {
+		return err
+	}
+	translatedContext, translatedCluster, translatedAuth, err := from.names(naming, NameData{
+		Context: kubeContextName,
+		Cluster: kubeContext.Cluster,
+		User:    kubeContext.AuthInfo,
+	})
+	if err != nil {
+		return err
 	}
 
-	// if we need to autodetect we will use the same ip used to connect by ssh
-	// or 127.0.0.1 for localhost
-	// and the same port as the one from the api string. We cant autodetect a different port.
-	if from.SrcDef.AutodetectApi {
-		apiUrl, err := url.Parse(k.Config.Clusters[translatedCluster].Server)
+	cluster := from.Config.Clusters[kubeContext.Cluster].DeepCopy()
+	auth := from.Config.AuthInfos[kubeContext.AuthInfo].DeepCopy()
+	context := kubeContext.DeepCopy()
+
+	owner := from.owner()
+	for _, extensions := range []*map[string]runtime.Object{&cluster.Extensions, &auth.Extensions, &context.Extensions} {
+		err = setOwner(extensions, owner)
 		if err != nil {
-			return fmt.Errorf("unable to parse existing API url. autodetecting api failed: %v", err)
-		}
-		hostStrings := strings.Split(apiUrl.Host, ":")
-		if len(hostStrings) < 2 {
-			return fmt.Errorf("unable to parse existing API url. unable to find current port")
+			return fmt.Errorf("unable to record the owner of %q: %v", translatedContext, err)
 		}
-		var kPort string
-		if from.SrcDef.OverridePort != "" {
-			kPort = from.SrcDef.OverridePort
-		} else {
-			kPort = hostStrings[1]
-		}
-		from.SrcDef.ApiAddress = fmt.Sprintf("https://%s:%s", from.SrcDef.OverrideIp, kPort)
-		k.Config.Clusters[translatedCluster].Server = from.SrcDef.ApiAddress
 	}
 
-	if from.SrcDef.Insecure {
-		k.Config.Clusters[translatedCluster].CertificateAuthority = ""
-		k.Config.Clusters[translatedCluster].CertificateAuthorityData = nil
-		k.Config.Clusters[translatedCluster].InsecureSkipTLSVerify = true
+	translatedContext, err = k.mergeEntries(from.Label, entries{
+		context:       context,
+		cluster:       cluster,
+		user:          auth,
+		contextName:   translatedContext,
+		clusterName:   translatedCluster,
+		userName:      translatedAuth,
+		sourceContext: kubeContextName,
+		sourceCluster: kubeContext.Cluster,
+		sourceUser:    kubeContext.AuthInfo,
+	}, from.SrcDef)
+	if err != nil || translatedContext == "" {
+		return err
 	}
 	if k.Config.CurrentContext == "" {
 		k.Config.CurrentContext = translatedContext
@@ -255,7 +524,7 @@ func TruncateDestination(path string) error {
 
 func (k *KubeConfig) MergeOne(sourceKonfig *KubeConfig) error {
 
-	err := k.CopyCurrentContext(sourceKonfig)
+	err := k.CopyContexts(sourceKonfig)
 	if err != nil {
 		return fmt.Errorf("unable merge config: %v: %v", sourceKonfig.Url, err)
 	}
@@ -267,33 +536,48 @@ func (k *KubeConfig) MergeOne(sourceKonfig *KubeConfig) error {
 	return nil
 }
 
-func (k *KubeConfig) Delete(label string) error {
+// Delete removes the contexts, with their clusters and users unless other contexts still use them.
+func (k *KubeConfig) Delete(contextNames ...string) error {
 
 	err := k.ReadConfig()
 	if err != nil {
 		log.Fatalf("unable to parse destination: %v: %v", k.Url, err)
 	}
 
-	var removeCluster string
-	var removeUser string
-	if cluster, ok := k.Config.Contexts[label]; ok {
-		removeCluster = cluster.Cluster
-		removeUser = cluster.AuthInfo
-		delete(k.Config.Contexts, label)
-	} else {
-		return fmt.Errorf("cluster named: %s not found", label)
+	removeClusters := make(map[string]string)
+	removeUsers := make(map[string]string)
+	for _, label := range contextNames {
+		if cluster, ok := k.Config.Contexts[label]; ok {
+			removeClusters[cluster.Cluster] = label
+			removeUsers[cluster.AuthInfo] = label
+			delete(k.Config.Contexts, label)
+		} else {
+			return fmt.Errorf("cluster named: %s not found", label)
+		}
+	}
+	for _, context := range k.Config.Contexts {
+		delete(removeClusters, context.Cluster)
+		delete(removeUsers, context.AuthInfo)
+	}
+
+	for removeUser, label := range removeUsers {
+		if _, ok := k.Config.AuthInfos[removeUser]; ok {
+			delete(k.Config.AuthInfos, removeUser)
+		} else {
+			log.Warnf("user %s not found. continuing", label)
+		}
 	}
 
-	if _, ok := k.Config.AuthInfos[removeUser]; ok {
-		delete(k.Config.AuthInfos, removeUser)
-	} else {
-		log.Warnf("user %s not found. continuing", label)
+	for removeCluster, label := range removeClusters {
+		if _, ok := k.Config.Clusters[removeCluster]; ok {
+			delete(k.Config.Clusters, removeCluster)
+		} else {
+			log.Warnf("cluster %s not found. continuing", label)
+		}
 	}
 
-	if _, ok := k.Config.Clusters[removeCluster]; ok {
-		delete(k.Config.Clusters, removeCluster)
-	} else {
-		log.Warnf("cluster %s not found. continuing", label)
+	if _, ok := k.Config.Contexts[k.Config.CurrentContext]; !ok {
+		k.Config.CurrentContext = ""
 	}
 
 	err = k.WriteConfig()
@@ -316,7 +600,7 @@ func (k *KubeConfig) List(label string, source cfg.Source) error {
 	if err != nil {
 		log.Fatalf("unable to parse destination: %v: %v", sourceKonfig.Url, err)
 	}
-	err = k.CopyCurrentContext(sourceKonfig)
+	err = k.CopyContexts(sourceKonfig)
 	if err != nil {
 		return fmt.Errorf("unable merge config: %v: %v", sourceKonfig.Url, err)
 	}
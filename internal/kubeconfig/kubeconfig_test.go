@@ -17,8 +17,16 @@ package kubeconfig
 
 import (
 	"github.com/k0kubun/pp"
+	"github.com/spf13/viper"
 	"github.com/stefan-kiss/khg/internal/cfg"
+	"io"
+	"io/ioutil"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -57,6 +65,65 @@ func TestKubeConfig_ReadConfig(t *testing.T) {
 			k:       kubeValidSrc,
 			wantErr: false,
 		},
+		{
+			name: "ExecSource",
+			k: KubeConfig{
+				Url:    &url.URL{Scheme: "exec"},
+				SrcDef: cfg.Source{Command: "cat config.src.yaml", Dir: "../../test/kubeconfig", Timeout: "10s"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "ExecSourceUrlCommand",
+			k: KubeConfig{
+				Url: &url.URL{Scheme: "exec", RawQuery: "cmd=cat+../../test/kubeconfig/config.src.yaml"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "TfstateSource",
+			k: KubeConfig{
+				Url: &url.URL{Scheme: "tfstate", Path: "../../test/kubeconfig/terraform.tfstate"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "TfstateSourceNested",
+			k: KubeConfig{
+				Url: &url.URL{Scheme: "tfstate", Path: "../../test/kubeconfig/terraform.tfstate", RawQuery: "output=clusters.prod.kube_admin_config_raw"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "TfstateSourceMissingOutput",
+			k: KubeConfig{
+				Url: &url.URL{Scheme: "tfstate", Path: "../../test/kubeconfig/terraform.tfstate", RawQuery: "output=kube_config"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExecSourceFails",
+			k: KubeConfig{
+				Url:    &url.URL{Scheme: "exec"},
+				SrcDef: cfg.Source{Command: "exit 1"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExecSourceNoCommand",
+			k: KubeConfig{
+				Url: &url.URL{Scheme: "exec"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ExecSourceBadTimeout",
+			k: KubeConfig{
+				Url:    &url.URL{Scheme: "exec"},
+				SrcDef: cfg.Source{Command: "cat ../../test/kubeconfig/config.src.yaml", Timeout: "soon"},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -105,3 +172,134 @@ func TestKubeConfig_CopyCurrentContext(t *testing.T) {
 		})
 	}
 }
+
+func TestSourceInit_Stdin(t *testing.T) {
+	valid, err := ioutil.ReadFile("../../test/kubeconfig/config.src.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		source  string
+		stdin   string
+		wantErr bool
+	}{
+		{name: "Dash", source: "-", stdin: string(valid)},
+		{name: "Url", source: "stdin://", stdin: string(valid)},
+		{name: "Empty", source: "-", stdin: "", wantErr: true},
+		{name: "NotKubeconfig", source: "-", stdin: "{", wantErr: true},
+	}
+	defer func(stdin io.Reader) { Stdin = stdin }(Stdin)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Stdin = strings.NewReader(tt.stdin)
+			if !IsStdin(tt.source) {
+				t.Errorf("IsStdin() = false, want true")
+			}
+			k, err := SourceInit(cfg.Source{Source: tt.source}, "piped")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SourceInit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(k.Config.Contexts) == 0 {
+				t.Errorf("SourceInit() got no contexts")
+			}
+		})
+	}
+}
+
+func TestKubeConfig_CopyContexts(t *testing.T) {
+	source := func() clientcmdapi.Config {
+		c := testDistConfig("prod-admin", "prod", "admin", "https://prod.example.com:6443")
+		c.Contexts["prod-view"] = &clientcmdapi.Context{Cluster: "prod", AuthInfo: "viewer"}
+		c.Contexts["staging-admin"] = &clientcmdapi.Context{Cluster: "staging", AuthInfo: "admin"}
+		c.Clusters["staging"] = &clientcmdapi.Cluster{Server: "https://staging.example.com:6443"}
+		c.AuthInfos["viewer"] = &clientcmdapi.AuthInfo{Token: "view"}
+		return c
+	}
+	tests := []struct {
+		name    string
+		src     cfg.Source
+		want    []string
+		wantErr bool
+	}{
+		{name: "Current", want: []string{"prod-admin@ext"}},
+		{name: "All", src: cfg.Source{AllContexts: true}, want: []string{"prod-admin@ext", "prod-view@ext", "staging-admin@ext"}},
+		{name: "Names", src: cfg.Source{Contexts: []string{"staging-admin"}}, want: []string{"staging-admin@ext"}},
+		{name: "Regex", src: cfg.Source{ContextRegex: "-admin$"}, want: []string{"prod-admin@ext", "staging-admin@ext"}},
+		{name: "NamesAndRegex", src: cfg.Source{Contexts: []string{"prod-view"}, ContextRegex: "^staging"}, want: []string{"prod-view@ext", "staging-admin@ext"}},
+		{name: "MissingName", src: cfg.Source{Contexts: []string{"dev"}}, wantErr: true},
+		{name: "NoMatch", src: cfg.Source{ContextRegex: "^dev"}, wantErr: true},
+		{name: "BadRegex", src: cfg.Source{ContextRegex: "("}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := &KubeConfig{Config: source(), Label: "ext", SrcDef: tt.src}
+			from.SrcDef.Insecure = true
+			dest := &KubeConfig{Config: *clientcmdapi.NewConfig()}
+			err := dest.CopyContexts(from)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CopyContexts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make([]string, 0)
+			for name, context := range dest.Config.Contexts {
+				got = append(got, name)
+				if dest.Config.Clusters[context.Cluster] == nil || dest.Config.AuthInfos[context.AuthInfo] == nil {
+					t.Errorf("CopyContexts() context %q points to missing entries: %v", name, context)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CopyContexts() got = %v, want %v", got, tt.want)
+			}
+			if dest.Config.CurrentContext != tt.want[0] {
+				t.Errorf("CopyContexts() current context = %q, want %q", dest.Config.CurrentContext, tt.want[0])
+			}
+			if from.Config.Clusters["prod"].InsecureSkipTLSVerify || from.Config.Contexts["prod-admin"].Cluster != "prod" {
+				t.Errorf("CopyContexts() changed the source: %v", from.Config)
+			}
+		})
+	}
+}
+
+// TestSourceInit_PersistRewriteApi saves a source read with --rewrite-api like get -p and reads it again like gather.
+func TestSourceInit_PersistRewriteApi(t *testing.T) {
+	defer viper.SetConfigFile("")
+	viper.SetConfigFile(filepath.Join(t.TempDir(), "khg.yaml"))
+	fileName, err := filepath.Abs("../../test/kubeconfig/config.src.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := cfg.Source{Source: "file://" + fileName, Profile: ProfileNone, Insecure: true, AutodetectApi: true}
+	got, err := SourceInit(src, "lab")
+	if err != nil {
+		t.Fatalf("SourceInit() error = %v", err)
+	}
+	err = cfg.Add(&cfg.Cfg{Sources: map[string]cfg.Source{}}, got.Label, got.SrcDef)
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	err = viper.ReadInConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := cfg.Cfg{}
+	err = viper.Unmarshal(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered, err := SourceInit(saved.Sources["lab"], "lab")
+	if err != nil {
+		t.Fatalf("SourceInit() saved source error = %v", err)
+	}
+	for _, k := range []*KubeConfig{got, gathered} {
+		cluster := k.Config.Clusters[k.Config.Contexts[k.Config.CurrentContext].Cluster]
+		if cluster.Server != "https://127.0.0.1:6443" || !cluster.InsecureSkipTLSVerify {
+			t.Errorf("SourceInit() server = %q, insecure = %v, want https://127.0.0.1:6443, true", cluster.Server, cluster.InsecureSkipTLSVerify)
+		}
+	}
+}
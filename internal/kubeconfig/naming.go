@@ -0,0 +1,127 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"text/template"
+)
+
+const (
+	DefaultContextTemplate = "{{.Context}}@{{.Label}}"
+	DefaultClusterTemplate = "{{.Cluster}}@{{.Label}}"
+	DefaultUserTemplate    = "{{.User}}@{{.Label}}"
+)
+
+// NameData is what naming templates can use. Context, Cluster and User are the names in the source.
+type NameData struct {
+	Label        string
+	Context      string
+	Cluster      string
+	User         string
+	Host         string
+	Distribution string
+}
+
+// SourceNaming returns the naming templates of the source, completed from the global naming setting and the defaults.
+func SourceNaming(src cfg.Source) (cfg.Naming, error) {
+	naming := cfg.Naming{}
+	if src.Naming != nil {
+		naming = *src.Naming
+	}
+	global := cfg.Naming{}
+	err := viper.UnmarshalKey("naming", &global)
+	if err != nil {
+		return naming, fmt.Errorf("unable to read naming: %v", err)
+	}
+	for _, t := range []struct {
+		template *string
+		global   string
+		def      string
+	}{
+		{&naming.Context, global.Context, DefaultContextTemplate},
+		{&naming.Cluster, global.Cluster, DefaultClusterTemplate},
+		{&naming.User, global.User, DefaultUserTemplate},
+	} {
+		if *t.template == "" {
+			*t.template = t.global
+		}
+		if *t.template == "" {
+			*t.template = t.def
+		}
+	}
+	return naming, nil
+}
+
+// CheckNaming returns an error for naming templates that do not parse.
+func CheckNaming(src cfg.Source) error {
+	naming, err := SourceNaming(src)
+	if err != nil {
+		return err
+	}
+	for _, t := range []string{naming.Context, naming.Cluster, naming.User} {
+		_, err = renderName(t, NameData{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderName(nameTemplate string, data NameData) (string, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse naming template: %q: %v", nameTemplate, err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("unable to render naming template: %q: %v", nameTemplate, err)
+	}
+	return buf.String(), nil
+}
+
+// names renders the names a context of the source is merged with.
+func (k *KubeConfig) names(naming cfg.Naming, data NameData) (context string, cluster string, user string, err error) {
+	data.Label = k.Label
+	if k.Url != nil {
+		data.Host = k.Url.Hostname()
+	}
+	data.Distribution = k.distribution()
+	names := make([]string, 0, 3)
+	for _, t := range []string{naming.Context, naming.Cluster, naming.User} {
+		name, err := renderName(t, data)
+		if err != nil {
+			return "", "", "", err
+		}
+		if name == "" {
+			return "", "", "", fmt.Errorf("naming template %q gives an empty name for context %q", t, data.Context)
+		}
+		names = append(names, name)
+	}
+	return names[0], names[1], names[2], nil
+}
+
+// distribution returns the profile applied to the source, else the distribution detected while probing.
+func (k *KubeConfig) distribution() string {
+	if k.Profile != "" {
+		return k.Profile
+	}
+	return k.Distribution
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net/url"
+	"testing"
+)
+
+func TestCopyContext_Naming(t *testing.T) {
+	defer viper.Set("naming", nil)
+	tests := []struct {
+		name        string
+		global      map[string]string
+		naming      *cfg.Naming
+		wantContext string
+		wantCluster string
+		wantUser    string
+		wantErr     bool
+	}{
+		{
+			name:        "Default",
+			wantContext: "k3s@lab",
+			wantCluster: "k3s@lab",
+			wantUser:    "k3s@lab",
+		},
+		{
+			name:        "Global",
+			global:      map[string]string{"context": "{{.Label}}", "user": "{{.Label}}-{{.User}}"},
+			wantContext: "lab",
+			wantCluster: "k3s@lab",
+			wantUser:    "lab-k3s",
+		},
+		{
+			name:        "Source",
+			global:      map[string]string{"context": "{{.Label}}"},
+			naming:      &cfg.Naming{Context: "{{.Distribution}}-{{.Host}}", Cluster: "{{.Host}}"},
+			wantContext: "k3s-10.0.0.1",
+			wantCluster: "10.0.0.1",
+			wantUser:    "k3s@lab",
+		},
+		{
+			name:    "Empty",
+			naming:  &cfg.Naming{Context: "{{if false}}x{{end}}"},
+			wantErr: true,
+		},
+		{
+			name:    "UnknownField",
+			naming:  &cfg.Naming{Context: "{{.Namespace}}"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("naming", tt.global)
+			from := &KubeConfig{
+				Url:    &url.URL{Scheme: "ssh", Host: "10.0.0.1"},
+				Config: testDistConfig("default", "default", "default", "https://127.0.0.1:6443"),
+				Label:  "lab",
+				SrcDef: cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1", Naming: tt.naming},
+			}
+			err := from.ApplyProfile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := &KubeConfig{Config: *clientcmdapi.NewConfig()}
+			err = dest.CopyCurrentContext(from)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CopyCurrentContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			context, ok := dest.Config.Contexts[tt.wantContext]
+			if !ok || context.Cluster != tt.wantCluster || context.AuthInfo != tt.wantUser {
+				t.Fatalf("CopyCurrentContext() got = %v, want %q, %q, %q", dest.Config.Contexts, tt.wantContext, tt.wantCluster, tt.wantUser)
+			}
+			if dest.Config.Clusters[tt.wantCluster] == nil || dest.Config.AuthInfos[tt.wantUser] == nil {
+				t.Errorf("CopyCurrentContext() cluster or user missing: %v", dest.Config)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ExtensionName is the name of the extension khg records the owner of the contexts, clusters and users it writes in.
+const ExtensionName = "khg"
+
+// Owner is the source a context, cluster or user was merged from.
+type Owner struct {
+	// Label the entry was merged with
+	Label string `json:"label"`
+	// Group is the label of the expanding source the entry comes from, if any
+	Group  string `json:"group,omitempty"`
+	Source string `json:"source"`
+	// Fetched is when the source was read
+	Fetched time.Time `json:"fetched"`
+	// Sha256 of the kube configuration read from the source
+	Sha256 string `json:"sha256"`
+}
+
+// owner returns the owner recorded for the source configuration read by k.
+func (k *KubeConfig) owner() Owner {
+	sum := sha256.Sum256(k.Bytes)
+	o := Owner{
+		Label:   k.Label,
+		Group:   k.Group,
+		Fetched: k.Fetched,
+		Sha256:  hex.EncodeToString(sum[:]),
+	}
+	if k.Url != nil {
+		o.Source = k.Url.Redacted()
+	}
+	return o
+}
+
+// setOwner records the owner in the extensions of an entry.
+func setOwner(extensions *map[string]runtime.Object, o Owner) error {
+	raw, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if *extensions == nil {
+		*extensions = make(map[string]runtime.Object)
+	}
+	(*extensions)[ExtensionName] = &runtime.Unknown{Raw: raw, ContentType: runtime.ContentTypeJSON}
+	return nil
+}
+
+// ownerOf returns the owner recorded in the extensions of an entry.
+func ownerOf(extensions map[string]runtime.Object) (Owner, bool) {
+	o := Owner{}
+	unknown, ok := extensions[ExtensionName].(*runtime.Unknown)
+	if !ok {
+		return o, false
+	}
+	err := json.Unmarshal(unknown.Raw, &o)
+	if err != nil || o.Label == "" {
+		return o, false
+	}
+	return o, true
+}
+
+// ContextOwner returns the source the context was merged from. Contexts khg did not write have no owner.
+func (k *KubeConfig) ContextOwner(contextName string) (Owner, bool) {
+	context, ok := k.Config.Contexts[contextName]
+	if !ok {
+		return Owner{}, false
+	}
+	return ownerOf(context.Extensions)
+}
+
+// OwnedContexts returns the contexts merged with the label or, for expanding sources, from the sources it stands for.
+func (k *KubeConfig) OwnedContexts(label string, expanding bool) []string {
+	names := make([]string, 0)
+	for _, name := range k.contextNames() {
+		o, ok := k.ContextOwner(name)
+		if !ok {
+			continue
+		}
+		if (!expanding && o.Label == label && o.Group == "") || (expanding && o.Group == label) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// removeOwned removes the entries merged with the label, so merging a source again replaces its entries.
+func (k *KubeConfig) removeOwned(label string) {
+	owned := func(extensions map[string]runtime.Object) bool {
+		o, ok := ownerOf(extensions)
+		return ok && o.Label == label
+	}
+	for name, context := range k.Config.Contexts {
+		if owned(context.Extensions) {
+			delete(k.Config.Contexts, name)
+		}
+	}
+	// deduplicated contexts of other sources may use them
+	usedClusters := make(map[string]bool)
+	usedUsers := make(map[string]bool)
+	for _, context := range k.Config.Contexts {
+		usedClusters[context.Cluster] = true
+		usedUsers[context.AuthInfo] = true
+	}
+	for name, cluster := range k.Config.Clusters {
+		if owned(cluster.Extensions) && !usedClusters[name] {
+			delete(k.Config.Clusters, name)
+		}
+	}
+	for name, user := range k.Config.AuthInfos {
+		if owned(user.Extensions) && !usedUsers[name] {
+			delete(k.Config.AuthInfos, name)
+		}
+	}
+	if _, ok := k.Config.Contexts[k.Config.CurrentContext]; !ok {
+		k.Config.CurrentContext = ""
+	}
+}
+
+// AdoptLegacy records the owner of the entries older versions merged, named "<name>@<label>" and without owner,
+// for the configured labels. Merging the source again then replaces them like the entries it owns.
+// Expanding sources are left out, their entries were named after the sources they stand for.
+func (k *KubeConfig) AdoptLegacy(sources map[string]cfg.Source) error {
+	labels := make([]string, 0, len(sources))
+	for label, src := range sources {
+		if !IsExpanding(src) {
+			labels = append(labels, label)
+		}
+	}
+	adopt := func(kind string, name string, extensions *map[string]runtime.Object) error {
+		if _, ok := ownerOf(*extensions); ok {
+			return nil
+		}
+		label := legacyLabel(name, labels)
+		if label == "" {
+			return nil
+		}
+		o := Owner{Label: label, Source: normalizeSource(sources[label].Source)}
+		if u, err := url.Parse(o.Source); err == nil {
+			o.Source = u.Redacted()
+		}
+		log.Infof("%s %q was merged by an older version, recording source %q as its owner", kind, name, label)
+		return setOwner(extensions, o)
+	}
+	for name, context := range k.Config.Contexts {
+		if err := adopt("context", name, &context.Extensions); err != nil {
+			return err
+		}
+	}
+	for name, cluster := range k.Config.Clusters {
+		if err := adopt("cluster", name, &cluster.Extensions); err != nil {
+			return err
+		}
+	}
+	for name, user := range k.Config.AuthInfos {
+		if err := adopt("user", name, &user.Extensions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyLabel returns the longest of the labels the name ends with as "@<label>".
+func legacyLabel(name string, labels []string) string {
+	found := ""
+	for _, label := range labels {
+		if len(label) > len(found) && strings.HasSuffix(name, "@"+label) && len(name) > len(label)+1 {
+			found = label
+		}
+	}
+	return found
+}
+
+// OrphanedContexts returns the contexts merged from sources that are no longer configured.
+func (k *KubeConfig) OrphanedContexts(sources map[string]cfg.Source) []string {
+	names := make([]string, 0)
+	for _, name := range k.contextNames() {
+		o, ok := k.ContextOwner(name)
+		if !ok {
+			continue
+		}
+		label := o.Label
+		if o.Group != "" {
+			label = o.Group
+		}
+		if _, ok := sources[label]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// ProfileAuto picks the profile from the detected distribution, the CA or the names in the kube configuration.
+	// It is the default of get and import, which save it with the source.
+	ProfileAuto = "auto"
+	// ProfileNone merges the kube configuration as it is.
+	// Sources without a profile, saved before profiles existed, use it too, keeping their names and api address.
+	ProfileNone = "none"
+)
+
+// Profile holds the fix-ups a kubernetes distribution needs before its kube configuration is merged.
+type Profile struct {
+	Name string
+	// Contexts are the context names the distribution writes, used to detect it.
+	Contexts []string
+	// ContextPrefix detects distributions that name the context after the cluster.
+	ContextPrefix string
+	// CAPrefix is the start of the common name of the cluster CA the distribution generates, used to detect it.
+	CAPrefix string
+	// RewriteApi replaces a loopback api address with the address of the host the configuration was read from.
+	RewriteApi bool
+	// ServerName is in the api certificate, it is verified instead of the rewritten address.
+	ServerName string
+	// Rename replaces the generic context, cluster and user names with the profile name.
+	Rename bool
+	// RandomPort is set for distributions publishing the api on a port picked when the cluster is created,
+	// on loopback unless configured otherwise. The port is kept and only an unspecified address is rewritten.
+	RandomPort bool
+}
+
+// Profiles are the built-in distribution profiles.
+var Profiles = map[string]Profile{
+	"k3s":      {Name: "k3s", Contexts: []string{"default"}, CAPrefix: "k3s-", RewriteApi: true, ServerName: "kubernetes", Rename: true},
+	"rke2":     {Name: "rke2", CAPrefix: "rke2-", RewriteApi: true, ServerName: "kubernetes", Rename: true},
+	"kubeadm":  {Name: "kubeadm", Contexts: []string{"kubernetes-admin@kubernetes"}, RewriteApi: true, ServerName: "kubernetes", Rename: true},
+	"microk8s": {Name: "microk8s", Contexts: []string{"microk8s"}, RewriteApi: true, ServerName: "kubernetes", Rename: true},
+	"k0s":      {Name: "k0s", Contexts: []string{"Default"}, RewriteApi: true, ServerName: "kubernetes", Rename: true},
+	"kind":     {Name: "kind", ContextPrefix: "kind-", RewriteApi: true, ServerName: "kubernetes", RandomPort: true},
+}
+
+// ProfileNames returns the valid values of the profile setting.
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{ProfileAuto, ProfileNone}, names...)
+}
+
+// CheckProfile returns an error for unknown profile names.
+func CheckProfile(name string) error {
+	if name == "" || name == ProfileAuto || name == ProfileNone {
+		return nil
+	}
+	if _, ok := Profiles[name]; !ok {
+		return fmt.Errorf("unknown profile: %q, valid profiles: %s", name, strings.Join(ProfileNames(), ", "))
+	}
+	return nil
+}
+
+// detectProfile returns the profile of the distribution found while probing the host or,
+// failing that, of the CA or the current context name. k3s and rke2 write the same names, only their CA tells them apart.
+func (k *KubeConfig) detectProfile() (Profile, bool) {
+	if p, ok := Profiles[k.Distribution]; ok {
+		return p, true
+	}
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ca := k.caCommonName()
+	for _, name := range names {
+		if p := Profiles[name]; p.CAPrefix != "" && strings.HasPrefix(ca, p.CAPrefix) {
+			return p, true
+		}
+	}
+	for _, name := range names {
+		p := Profiles[name]
+		if p.CAPrefix != "" && ca != "" {
+			// the CA is not the one of the distribution
+			continue
+		}
+		for _, c := range p.Contexts {
+			if k.Config.CurrentContext == c {
+				return p, true
+			}
+		}
+		if p.ContextPrefix != "" && strings.HasPrefix(k.Config.CurrentContext, p.ContextPrefix) {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// caCommonName returns the common name of the CA of the current cluster, empty when it is not embedded or does not parse.
+func (k *KubeConfig) caCommonName() string {
+	context, ok := k.Config.Contexts[k.Config.CurrentContext]
+	if !ok {
+		return ""
+	}
+	cluster, ok := k.Config.Clusters[context.Cluster]
+	if !ok {
+		return ""
+	}
+	block, _ := pem.Decode(cluster.CertificateAuthorityData)
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// profile returns the profile set for the source, if any.
+func (k *KubeConfig) profile() (Profile, bool, error) {
+	switch k.SrcDef.Profile {
+	case "", ProfileNone:
+		return Profile{}, false, nil
+	case ProfileAuto:
+		p, ok := k.detectProfile()
+		return p, ok, nil
+	}
+	p, ok := Profiles[k.SrcDef.Profile]
+	if !ok {
+		return Profile{}, false, CheckProfile(k.SrcDef.Profile)
+	}
+	return p, true, nil
+}
+
+// ApplyProfile applies the profile of the source to the current context of the kube configuration.
+// Settings of the source (api-address, rewrite-api, insecure) take precedence.
+func (k *KubeConfig) ApplyProfile() error {
+	p, ok, err := k.profile()
+	if err != nil || !ok {
+		return err
+	}
+	log.Infof("applying %s profile to %s", p.Name, k.SrcDef.Source)
+	k.Profile = p.Name
+
+	// other contexts may share the cluster and user of the current one
+	if p.Rename && len(k.Config.Contexts) == 1 {
+		k.renameCurrent(p.Name)
+	}
+	context, ok := k.Config.Contexts[k.Config.CurrentContext]
+	if !ok {
+		return nil
+	}
+	cluster, ok := k.Config.Clusters[context.Cluster]
+	if !ok {
+		return nil
+	}
+	if !p.RewriteApi || k.SrcDef.ApiAddress != "" || k.SrcDef.AutodetectApi || isLoopback(k.SrcDef.OverrideIp) {
+		return nil
+	}
+	apiUrl, err := url.Parse(cluster.Server)
+	if err != nil {
+		return fmt.Errorf("unable to parse api url: %q: %v", cluster.Server, err)
+	}
+	if !isLoopback(apiUrl.Hostname()) {
+		return nil
+	}
+	port := apiUrl.Port()
+	if p.RandomPort {
+		if ip := net.ParseIP(apiUrl.Hostname()); ip == nil || !ip.IsUnspecified() {
+			log.Warnf("%s publishes the api on %s of %s only, keeping it. set the api server address of the cluster to 0.0.0.0 to reach it from here",
+				p.Name, apiUrl.Host, k.SrcDef.OverrideIp)
+			return nil
+		}
+		if k.SrcDef.OverridePort != "" {
+			log.Warnf("%s picks the api port when the cluster is created, keeping port %s instead of %s", p.Name, port, k.SrcDef.OverridePort)
+		}
+	} else if k.SrcDef.OverridePort != "" {
+		port = k.SrcDef.OverridePort
+	}
+	apiUrl.Host = net.JoinHostPort(k.SrcDef.OverrideIp, port)
+	log.Infof("rewriting api address %q to %q", cluster.Server, apiUrl.String())
+	cluster.Server = apiUrl.String()
+	if p.ServerName != "" && cluster.TLSServerName == "" && !k.SrcDef.Insecure {
+		cluster.TLSServerName = p.ServerName
+	}
+	return nil
+}
+
+// renameCurrent renames the current context, its cluster and its user.
+func (k *KubeConfig) renameCurrent(name string) {
+	c := &k.Config
+	context, ok := c.Contexts[c.CurrentContext]
+	if !ok {
+		return
+	}
+	context = context.DeepCopy()
+	if cluster, ok := c.Clusters[context.Cluster]; ok {
+		delete(c.Clusters, context.Cluster)
+		c.Clusters[name] = cluster
+		context.Cluster = name
+	}
+	if auth, ok := c.AuthInfos[context.AuthInfo]; ok {
+		delete(c.AuthInfos, context.AuthInfo)
+		c.AuthInfos[name] = auth
+		context.AuthInfo = name
+	}
+	delete(c.Contexts, c.CurrentContext)
+	c.Contexts[name] = context
+	c.CurrentContext = name
+}
+
+// isLoopback reports whether the host is empty, a loopback or an unspecified address.
+func isLoopback(host string) bool {
+	if host == "" || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testDistConfig(context string, cluster string, user string, server string) clientcmdapi.Config {
+	return clientcmdapi.Config{
+		CurrentContext: context,
+		Contexts:       map[string]*clientcmdapi.Context{context: {Cluster: cluster, AuthInfo: user}},
+		Clusters:       map[string]*clientcmdapi.Cluster{cluster: {Server: server, CertificateAuthorityData: []byte("ca")}},
+		AuthInfos:      map[string]*clientcmdapi.AuthInfo{user: {Token: "token"}},
+	}
+}
+
+// testCAConfig is a distribution config with a CA certificate with the common name.
+func testCAConfig(t *testing.T, commonName string) clientcmdapi.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testDistConfig("default", "default", "default", "https://127.0.0.1:6443")
+	config.Clusters["default"].CertificateAuthorityData = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return config
+}
+
+func TestApplyProfile(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         clientcmdapi.Config
+		distribution   string
+		src            cfg.Source
+		wantProfile    string
+		wantContext    string
+		wantServer     string
+		wantServerName string
+		wantErr        bool
+	}{
+		{
+			name:           "K3s",
+			config:         testDistConfig("default", "default", "default", "https://127.0.0.1:6443"),
+			src:            cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantProfile:    "k3s",
+			wantContext:    "k3s",
+			wantServer:     "https://10.0.0.1:6443",
+			wantServerName: "kubernetes",
+		},
+		{
+			name:           "Rke2Probed",
+			config:         testDistConfig("default", "default", "default", "https://127.0.0.1:6443"),
+			distribution:   "rke2",
+			src:            cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantProfile:    "rke2",
+			wantContext:    "rke2",
+			wantServer:     "https://10.0.0.1:6443",
+			wantServerName: "kubernetes",
+		},
+		{
+			name:           "Rke2CA",
+			config:         testCAConfig(t, "rke2-server-ca@1600000000"),
+			src:            cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantProfile:    "rke2",
+			wantContext:    "rke2",
+			wantServer:     "https://10.0.0.1:6443",
+			wantServerName: "kubernetes",
+		},
+		{
+			name:           "K3sCA",
+			config:         testCAConfig(t, "k3s-server-ca@1600000000"),
+			src:            cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantProfile:    "k3s",
+			wantContext:    "k3s",
+			wantServer:     "https://10.0.0.1:6443",
+			wantServerName: "kubernetes",
+		},
+		{
+			name:        "DefaultOtherCA",
+			config:      testCAConfig(t, "my-ca"),
+			src:         cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantContext: "default",
+			wantServer:  "https://127.0.0.1:6443",
+		},
+		{
+			name:           "Kubeadm",
+			config:         testDistConfig("kubernetes-admin@kubernetes", "kubernetes", "kubernetes-admin", "https://localhost:6443"),
+			src:            cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1", OverridePort: "16443"},
+			wantProfile:    "kubeadm",
+			wantContext:    "kubeadm",
+			wantServer:     "https://10.0.0.1:16443",
+			wantServerName: "kubernetes",
+		},
+		{
+			name:        "KubeadmExternalApi",
+			config:      testDistConfig("kubernetes-admin@kubernetes", "kubernetes", "kubernetes-admin", "https://lb.example.com:6443"),
+			src:         cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantProfile: "kubeadm",
+			wantContext: "kubeadm",
+			wantServer:  "https://lb.example.com:6443",
+		},
+		{
+			name:        "KindLocal",
+			config:      testDistConfig("kind-dev", "kind-dev", "kind-dev", "https://127.0.0.1:41235"),
+			src:         cfg.Source{Profile: ProfileAuto, OverrideIp: LocalHost},
+			wantProfile: "kind",
+			wantContext: "kind-dev",
+			wantServer:  "https://127.0.0.1:41235",
+		},
+		{
+			name:        "KindRemoteLoopback",
+			config:      testDistConfig("kind-dev", "kind-dev", "kind-dev", "https://127.0.0.1:41235"),
+			src:         cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantProfile: "kind",
+			wantContext: "kind-dev",
+			wantServer:  "https://127.0.0.1:41235",
+		},
+		{
+			name:           "KindRemoteAnyAddress",
+			config:         testDistConfig("kind-dev", "kind-dev", "kind-dev", "https://0.0.0.0:41235"),
+			src:            cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1", OverridePort: "6443"},
+			wantProfile:    "kind",
+			wantContext:    "kind-dev",
+			wantServer:     "https://10.0.0.1:41235",
+			wantServerName: "kubernetes",
+		},
+		{
+			name:        "Insecure",
+			config:      testDistConfig("microk8s", "microk8s-cluster", "admin", "https://127.0.0.1:16443"),
+			src:         cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1", Insecure: true},
+			wantProfile: "microk8s",
+			wantContext: "microk8s",
+			wantServer:  "https://10.0.0.1:16443",
+		},
+		{
+			name:        "ApiAddress",
+			config:      testDistConfig("Default", "local", "user", "https://127.0.0.1:6443"),
+			src:         cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1", ApiAddress: "https://api.example.com:6443"},
+			wantProfile: "k0s",
+			wantContext: "k0s",
+			wantServer:  "https://127.0.0.1:6443",
+		},
+		{
+			name:           "Explicit",
+			config:         testDistConfig("ctx", "cluster", "user", "https://[::1]:6443"),
+			src:            cfg.Source{Profile: "rke2", OverrideIp: "fd00::1"},
+			wantProfile:    "rke2",
+			wantContext:    "rke2",
+			wantServer:     "https://[fd00::1]:6443",
+			wantServerName: "kubernetes",
+		},
+		{
+			name:        "Unknown",
+			config:      testDistConfig("ctx", "cluster", "user", "https://127.0.0.1:6443"),
+			src:         cfg.Source{Profile: ProfileAuto, OverrideIp: "10.0.0.1"},
+			wantContext: "ctx",
+			wantServer:  "https://127.0.0.1:6443",
+		},
+		{
+			name:        "None",
+			config:      testDistConfig("default", "default", "default", "https://127.0.0.1:6443"),
+			src:         cfg.Source{Profile: ProfileNone, OverrideIp: "10.0.0.1"},
+			wantContext: "default",
+			wantServer:  "https://127.0.0.1:6443",
+		},
+		{
+			name:        "NotSet",
+			config:      testDistConfig("default", "default", "default", "https://127.0.0.1:6443"),
+			src:         cfg.Source{OverrideIp: "10.0.0.1"},
+			wantContext: "default",
+			wantServer:  "https://127.0.0.1:6443",
+		},
+		{
+			name:    "Invalid",
+			config:  testDistConfig("default", "default", "default", "https://127.0.0.1:6443"),
+			src:     cfg.Source{Profile: "openshift"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &KubeConfig{Config: tt.config, SrcDef: tt.src, Distribution: tt.distribution}
+			err := k.ApplyProfile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplyProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if k.Profile != tt.wantProfile || k.Config.CurrentContext != tt.wantContext {
+				t.Fatalf("ApplyProfile() profile = %q, context = %q, want %q, %q", k.Profile, k.Config.CurrentContext, tt.wantProfile, tt.wantContext)
+			}
+			context := k.Config.Contexts[tt.wantContext]
+			if context == nil || k.Config.AuthInfos[context.AuthInfo] == nil {
+				t.Fatalf("ApplyProfile() context or user missing: %v", k.Config)
+			}
+			cluster := k.Config.Clusters[context.Cluster]
+			if cluster == nil {
+				t.Fatalf("ApplyProfile() cluster missing: %v", k.Config)
+			}
+			if cluster.Server != tt.wantServer || cluster.TLSServerName != tt.wantServerName {
+				t.Errorf("ApplyProfile() server = %q, %q, want %q, %q", cluster.Server, cluster.TLSServerName, tt.wantServer, tt.wantServerName)
+			}
+			if len(k.Config.Contexts) != 1 || len(k.Config.Clusters) != 1 || len(k.Config.AuthInfos) != 1 {
+				t.Errorf("ApplyProfile() left renamed entries behind: %v", k.Config)
+			}
+		})
+	}
+}
@@ -0,0 +1,558 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change is a value of the source kube configuration changed by a rewrite rule.
+type Change struct {
+	// Rule is the name of the rule, or where it is defined when it has none
+	Rule string
+	// Kind is context, cluster or user
+	Kind  string
+	Name  string
+	Field string
+	Old   string
+	New   string
+}
+
+// field reads and writes one value of a context, cluster or user.
+type field struct {
+	get func(e interface{}) string
+	set func(e interface{}, v string) error
+	// hidden values, secrets and certificates, are shown by their size when explaining changes
+	hidden bool
+	// unsetOnly fields can be unset but not set
+	unsetOnly bool
+}
+
+func clusterField(get func(c *clientcmdapi.Cluster) *string) field {
+	return field{
+		get: func(e interface{}) string { return *get(e.(*clientcmdapi.Cluster)) },
+		set: func(e interface{}, v string) error { *get(e.(*clientcmdapi.Cluster)) = v; return nil },
+	}
+}
+
+func userField(get func(u *clientcmdapi.AuthInfo) *string, hidden bool) field {
+	return field{
+		get:    func(e interface{}) string { return *get(e.(*clientcmdapi.AuthInfo)) },
+		set:    func(e interface{}, v string) error { *get(e.(*clientcmdapi.AuthInfo)) = v; return nil },
+		hidden: hidden,
+	}
+}
+
+func userDataField(get func(u *clientcmdapi.AuthInfo) *[]byte) field {
+	return field{
+		get: func(e interface{}) string { return string(*get(e.(*clientcmdapi.AuthInfo))) },
+		set: func(e interface{}, v string) error {
+			*get(e.(*clientcmdapi.AuthInfo)) = []byte(v)
+			if v == "" {
+				*get(e.(*clientcmdapi.AuthInfo)) = nil
+			}
+			return nil
+		},
+		hidden: true,
+	}
+}
+
+// ClusterFields, ContextFields and UserFields are the fields rewrite rules can change, named as in kube configurations.
+var (
+	ClusterFields = map[string]field{
+		"server":                clusterField(func(c *clientcmdapi.Cluster) *string { return &c.Server }),
+		"proxy-url":             clusterField(func(c *clientcmdapi.Cluster) *string { return &c.ProxyURL }),
+		"tls-server-name":       clusterField(func(c *clientcmdapi.Cluster) *string { return &c.TLSServerName }),
+		"certificate-authority": clusterField(func(c *clientcmdapi.Cluster) *string { return &c.CertificateAuthority }),
+		"certificate-authority-data": {
+			get: func(e interface{}) string { return string(e.(*clientcmdapi.Cluster).CertificateAuthorityData) },
+			set: func(e interface{}, v string) error {
+				e.(*clientcmdapi.Cluster).CertificateAuthorityData = []byte(v)
+				if v == "" {
+					e.(*clientcmdapi.Cluster).CertificateAuthorityData = nil
+				}
+				return nil
+			},
+			hidden: true,
+		},
+		"insecure-skip-tls-verify": {
+			get: func(e interface{}) string {
+				if e.(*clientcmdapi.Cluster).InsecureSkipTLSVerify {
+					return "true"
+				}
+				return ""
+			},
+			set: func(e interface{}, v string) error {
+				if v == "" {
+					e.(*clientcmdapi.Cluster).InsecureSkipTLSVerify = false
+					return nil
+				}
+				insecure, err := strconv.ParseBool(v)
+				if err != nil {
+					return fmt.Errorf("invalid insecure-skip-tls-verify value: %q: %v", v, err)
+				}
+				e.(*clientcmdapi.Cluster).InsecureSkipTLSVerify = insecure
+				return nil
+			},
+		},
+	}
+	ContextFields = map[string]field{
+		"namespace": {
+			get: func(e interface{}) string { return e.(*clientcmdapi.Context).Namespace },
+			set: func(e interface{}, v string) error { e.(*clientcmdapi.Context).Namespace = v; return nil },
+		},
+	}
+	UserFields = map[string]field{
+		"token":                   userField(func(u *clientcmdapi.AuthInfo) *string { return &u.Token }, true),
+		"tokenFile":               userField(func(u *clientcmdapi.AuthInfo) *string { return &u.TokenFile }, false),
+		"username":                userField(func(u *clientcmdapi.AuthInfo) *string { return &u.Username }, false),
+		"password":                userField(func(u *clientcmdapi.AuthInfo) *string { return &u.Password }, true),
+		"client-certificate":      userField(func(u *clientcmdapi.AuthInfo) *string { return &u.ClientCertificate }, false),
+		"client-key":              userField(func(u *clientcmdapi.AuthInfo) *string { return &u.ClientKey }, false),
+		"as":                      userField(func(u *clientcmdapi.AuthInfo) *string { return &u.Impersonate }, false),
+		"client-certificate-data": userDataField(func(u *clientcmdapi.AuthInfo) *[]byte { return &u.ClientCertificateData }),
+		"client-key-data":         userDataField(func(u *clientcmdapi.AuthInfo) *[]byte { return &u.ClientKeyData }),
+		"exec": {
+			get: func(e interface{}) string {
+				if exec := e.(*clientcmdapi.AuthInfo).Exec; exec != nil {
+					return exec.Command
+				}
+				return ""
+			},
+			set: func(e interface{}, v string) error {
+				e.(*clientcmdapi.AuthInfo).Exec = nil
+				return nil
+			},
+			unsetOnly: true,
+		},
+		"auth-provider": {
+			get: func(e interface{}) string {
+				if provider := e.(*clientcmdapi.AuthInfo).AuthProvider; provider != nil {
+					return provider.Name
+				}
+				return ""
+			},
+			set: func(e interface{}, v string) error {
+				e.(*clientcmdapi.AuthInfo).AuthProvider = nil
+				return nil
+			},
+			unsetOnly: true,
+		},
+	}
+)
+
+// fieldNames returns the sorted names of the fields.
+func fieldNames(fields map[string]field) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupField returns the kind of entry a field belongs to and the field.
+func lookupField(name string) (string, field, error) {
+	if f, ok := ClusterFields[name]; ok {
+		return "cluster", f, nil
+	}
+	if f, ok := ContextFields[name]; ok {
+		return "context", f, nil
+	}
+	if f, ok := UserFields[name]; ok {
+		return "user", f, nil
+	}
+	all := append(append(fieldNames(ClusterFields), fieldNames(ContextFields)...), fieldNames(UserFields)...)
+	return "", field{}, fmt.Errorf("unknown field: %q, valid fields: %s", name, strings.Join(all, ", "))
+}
+
+// lookupUserField returns the auth field, drop and rename only apply to users.
+func lookupUserField(name string) (field, error) {
+	f, ok := UserFields[name]
+	if !ok {
+		return field{}, fmt.Errorf("unknown auth field: %q, valid auth fields: %s", name, strings.Join(fieldNames(UserFields), ", "))
+	}
+	return f, nil
+}
+
+// Rules returns the rewrite rules of the source: the ones of its api address and insecure settings first,
+// then the global ones, then its own. Rules can change what the settings did.
+func Rules(src cfg.Source) ([]cfg.Rule, error) {
+	global := make([]cfg.Rule, 0)
+	err := viper.UnmarshalKey("rewrite", &global)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rewrite rules: %v", err)
+	}
+	return append(append(settingRules(src), global...), src.Rewrite...), nil
+}
+
+// settingRules returns the rules doing what --api-address, --rewrite-api and --insecure used to do when merging.
+func settingRules(src cfg.Source) []cfg.Rule {
+	rules := make([]cfg.Rule, 0)
+	if src.AutodetectApi {
+		// the address used to connect by ssh, or 127.0.0.1 for localhost, and the port of the api url.
+		// we cant autodetect a different port.
+		port := "${1}"
+		if src.OverridePort != "" {
+			port = src.OverridePort
+		}
+		rules = append(rules, cfg.Rule{
+			Name:   "rewrite-api",
+			Server: &cfg.Replace{Regex: `^[^:/]+://[^/]*:([0-9]+)(/.*)?$`, Replace: "https://" + net.JoinHostPort(src.OverrideIp, port)},
+		})
+	} else if src.ApiAddress != "" {
+		rules = append(rules, cfg.Rule{Name: "api-address", Set: map[string]string{"server": src.ApiAddress}})
+	}
+	if src.Insecure {
+		rules = append(rules, cfg.Rule{
+			Name:  "insecure",
+			Set:   map[string]string{"insecure-skip-tls-verify": "true"},
+			Unset: []string{"certificate-authority", "certificate-authority-data"},
+		})
+	}
+	return rules
+}
+
+// CheckRules returns an error for rules with invalid regular expressions, fields or templates.
+func CheckRules(rules []cfg.Rule) error {
+	for i, rule := range rules {
+		_, err := compileRule(rule)
+		if err != nil {
+			return fmt.Errorf("rewrite rule %s: %v", ruleName(rule, i), err)
+		}
+	}
+	return nil
+}
+
+// ruleName names the rule in errors and explanations.
+func ruleName(rule cfg.Rule, i int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// compiledRule is a rule with its regular expressions compiled and its fields checked.
+type compiledRule struct {
+	cfg.Rule
+	label        *regexp.Regexp
+	host         *regexp.Regexp
+	distribution *regexp.Regexp
+	server       *regexp.Regexp
+}
+
+func compileRule(rule cfg.Rule) (compiledRule, error) {
+	c := compiledRule{Rule: rule}
+	var err error
+	for _, re := range []struct {
+		expr     string
+		compiled **regexp.Regexp
+	}{
+		{rule.Label, &c.label},
+		{rule.Host, &c.host},
+		{rule.Distribution, &c.distribution},
+	} {
+		if re.expr == "" {
+			continue
+		}
+		*re.compiled, err = regexp.Compile(re.expr)
+		if err != nil {
+			return c, fmt.Errorf("unable to parse regex: %q: %v", re.expr, err)
+		}
+	}
+	if rule.Server != nil {
+		c.server, err = regexp.Compile(rule.Server.Regex)
+		if err != nil {
+			return c, fmt.Errorf("unable to parse server regex: %q: %v", rule.Server.Regex, err)
+		}
+		_, err = renderName(rule.Server.Replace, NameData{})
+		if err != nil {
+			return c, err
+		}
+	}
+	for name, value := range rule.Set {
+		_, f, err := lookupField(name)
+		if err != nil {
+			return c, err
+		}
+		if f.unsetOnly {
+			return c, fmt.Errorf("field %q can only be unset", name)
+		}
+		_, err = renderName(value, NameData{})
+		if err != nil {
+			return c, err
+		}
+	}
+	for _, name := range rule.Unset {
+		_, _, err = lookupField(name)
+		if err != nil {
+			return c, err
+		}
+	}
+	for _, name := range rule.Drop {
+		_, err = lookupUserField(name)
+		if err != nil {
+			return c, err
+		}
+	}
+	for from, to := range rule.Rename {
+		for _, name := range []string{from, to} {
+			f, err := lookupUserField(name)
+			if err != nil {
+				return c, err
+			}
+			if f.unsetOnly {
+				return c, fmt.Errorf("auth field %q can not be renamed", name)
+			}
+		}
+	}
+	return c, nil
+}
+
+// matches reports whether the rule applies to the source.
+func (r compiledRule) matches(k *KubeConfig) bool {
+	host := ""
+	if k.Url != nil {
+		host = k.Url.Hostname()
+	}
+	for _, m := range []struct {
+		re    *regexp.Regexp
+		value string
+	}{
+		{r.label, k.Label},
+		{r.host, host},
+		{r.distribution, k.distribution()},
+	} {
+		if m.re != nil && !m.re.MatchString(m.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rewrite applies the rewrite rules of the source, in order, to every context, cluster and user of the kube configuration.
+// The changes are recorded in Changes.
+func (k *KubeConfig) Rewrite() error {
+	rules, err := Rules(k.SrcDef)
+	if err != nil {
+		return err
+	}
+	// the rules of the api address and insecure settings only change the clusters of the merged contexts
+	settings := len(settingRules(k.SrcDef))
+	var merged []string
+	mergedOnly := make(map[string]bool)
+	if settings > 0 {
+		merged, err = k.mergedClusters()
+		if err != nil {
+			return err
+		}
+		for _, name := range merged {
+			mergedOnly[name] = true
+		}
+	}
+	for i, rule := range rules {
+		r, err := compileRule(rule)
+		if err != nil {
+			return fmt.Errorf("rewrite rule %s: %v", ruleName(rule, i), err)
+		}
+		if !r.matches(k) {
+			continue
+		}
+		log.Debugf("applying rewrite rule %s to %s", ruleName(rule, i), k.Label)
+		var only map[string]bool
+		if i < settings {
+			only = mergedOnly
+		}
+		err = k.applyRule(r, ruleName(rule, i), only)
+		if err != nil {
+			return fmt.Errorf("rewrite rule %s: %v", ruleName(rule, i), err)
+		}
+		// the detected api address is saved with the source, gather has no --rewrite-api
+		if i < settings && r.Server != nil && len(merged) > 0 {
+			k.SrcDef.ApiAddress = k.Config.Clusters[merged[0]].Server
+		}
+	}
+	return nil
+}
+
+// mergedClusters returns the clusters of the contexts that will be merged: the current one, unless the source selects others.
+// The cluster of the current context comes first.
+func (k *KubeConfig) mergedClusters() ([]string, error) {
+	names := []string{k.Config.CurrentContext}
+	if k.SrcDef.AllContexts || len(k.SrcDef.Contexts) > 0 || k.SrcDef.ContextRegex != "" {
+		var err error
+		names, err = k.SelectContexts()
+		if err != nil {
+			return nil, err
+		}
+	}
+	clusters := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		context, ok := k.Config.Contexts[name]
+		if !ok || seen[context.Cluster] {
+			continue
+		}
+		if _, ok := k.Config.Clusters[context.Cluster]; !ok {
+			continue
+		}
+		seen[context.Cluster] = true
+		clusters = append(clusters, context.Cluster)
+	}
+	return clusters, nil
+}
+
+// ruleEntry is a context, cluster or user of the source a rule is applied to.
+type ruleEntry struct {
+	kind  string
+	name  string
+	entry interface{}
+	data  NameData
+}
+
+// ruleEntries returns the entries of the kube configuration sorted by kind and name.
+func (k *KubeConfig) ruleEntries() []ruleEntry {
+	data := NameData{Label: k.Label, Distribution: k.distribution()}
+	if k.Url != nil {
+		data.Host = k.Url.Hostname()
+	}
+	entries := make([]ruleEntry, 0)
+	for _, name := range k.contextNames() {
+		context := k.Config.Contexts[name]
+		d := data
+		d.Context, d.Cluster, d.User = name, context.Cluster, context.AuthInfo
+		entries = append(entries, ruleEntry{"context", name, context, d})
+	}
+	for _, name := range k.clusterNames() {
+		d := data
+		d.Cluster = name
+		entries = append(entries, ruleEntry{"cluster", name, k.Config.Clusters[name], d})
+	}
+	for _, name := range k.userNames() {
+		d := data
+		d.User = name
+		entries = append(entries, ruleEntry{"user", name, k.Config.AuthInfos[name], d})
+	}
+	return entries
+}
+
+// applyRule applies the rule to every entry, or only to the clusters in only when it is not nil.
+// The server regex must then match all of them: it finds the port of the api url.
+func (k *KubeConfig) applyRule(r compiledRule, rule string, only map[string]bool) error {
+	setNames := make([]string, 0, len(r.Set))
+	for name := range r.Set {
+		setNames = append(setNames, name)
+	}
+	sort.Strings(setNames)
+	renameNames := make([]string, 0, len(r.Rename))
+	for name := range r.Rename {
+		renameNames = append(renameNames, name)
+	}
+	sort.Strings(renameNames)
+
+	for _, e := range k.ruleEntries() {
+		if only != nil && (e.kind != "cluster" || !only[e.name]) {
+			continue
+		}
+		change := func(name string, f field, value string) error {
+			old := f.get(e.entry)
+			if old == value {
+				return nil
+			}
+			err := f.set(e.entry, value)
+			if err != nil {
+				return err
+			}
+			k.Changes = append(k.Changes, Change{Rule: rule, Kind: e.kind, Name: e.name, Field: name, Old: display(f, old), New: display(f, value)})
+			return nil
+		}
+
+		if r.server != nil && e.kind == "cluster" {
+			replace, err := renderName(r.Server.Replace, e.data)
+			if err != nil {
+				return err
+			}
+			f := ClusterFields["server"]
+			if only != nil && !r.server.MatchString(f.get(e.entry)) {
+				return fmt.Errorf("unable to find the port of the api url: %q", f.get(e.entry))
+			}
+			err = change("server", f, r.server.ReplaceAllString(f.get(e.entry), replace))
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range setNames {
+			kind, f, _ := lookupField(name)
+			if kind != e.kind {
+				continue
+			}
+			value, err := renderName(r.Set[name], e.data)
+			if err != nil {
+				return err
+			}
+			err = change(name, f, value)
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range append(r.Unset, r.Drop...) {
+			kind, f, _ := lookupField(name)
+			if kind != e.kind {
+				continue
+			}
+			err := change(name, f, "")
+			if err != nil {
+				return err
+			}
+		}
+		if e.kind != "user" {
+			continue
+		}
+		for _, from := range renameNames {
+			fromField, toField := UserFields[from], UserFields[r.Rename[from]]
+			value := fromField.get(e.entry)
+			if value == "" {
+				continue
+			}
+			err := change(r.Rename[from], toField, value)
+			if err != nil {
+				return err
+			}
+			err = change(from, fromField, "")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// display returns the value as shown when explaining changes.
+func display(f field, value string) string {
+	if f.hidden && value != "" {
+		return fmt.Sprintf("<%d bytes>", len(value))
+	}
+	return value
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubeconfig
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKubeConfig_Rewrite(t *testing.T) {
+	defer viper.Set("rewrite", nil)
+
+	tests := []struct {
+		name        string
+		global      []map[string]interface{}
+		src         cfg.Source
+		rules       []cfg.Rule
+		label       string
+		profile     string
+		wantServer  string
+		wantCluster map[string]string
+		wantContext map[string]string
+		wantUser    map[string]string
+		wantChanges []Change
+		wantErr     bool
+	}{
+		{
+			name:  "Server",
+			label: "lab",
+			rules: []cfg.Rule{
+				{Name: "public", Server: &cfg.Replace{Regex: `//[^:]+:`, Replace: "//{{.Host}}:"}},
+			},
+			wantServer: "https://node1.lab:6443",
+			wantChanges: []Change{
+				{Rule: "public", Kind: "cluster", Name: "admin", Field: "server", Old: "https://10.0.0.1:6443", New: "https://node1.lab:6443"},
+			},
+		},
+		{
+			name:  "SetUnsetDrop",
+			label: "lab",
+			rules: []cfg.Rule{
+				{
+					Set:   map[string]string{"namespace": "{{.Label}}", "proxy-url": "socks5://localhost:1080", "tls-server-name": "kubernetes"},
+					Unset: []string{"certificate-authority-data"},
+					Drop:  []string{"token"},
+				},
+			},
+			wantServer:  "https://10.0.0.1:6443",
+			wantCluster: map[string]string{"proxy-url": "socks5://localhost:1080", "tls-server-name": "kubernetes", "certificate-authority-data": ""},
+			wantContext: map[string]string{"namespace": "lab"},
+			wantUser:    map[string]string{"token": ""},
+			wantChanges: []Change{
+				{Rule: "#1", Kind: "context", Name: "admin", Field: "namespace", New: "lab"},
+				{Rule: "#1", Kind: "cluster", Name: "admin", Field: "proxy-url", New: "socks5://localhost:1080"},
+				{Rule: "#1", Kind: "cluster", Name: "admin", Field: "tls-server-name", New: "kubernetes"},
+				{Rule: "#1", Kind: "cluster", Name: "admin", Field: "certificate-authority-data", Old: "<2 bytes>"},
+				{Rule: "#1", Kind: "user", Name: "admin", Field: "token", Old: "<5 bytes>"},
+			},
+		},
+		{
+			name:       "Rename",
+			label:      "lab",
+			rules:      []cfg.Rule{{Rename: map[string]string{"token": "password"}}},
+			wantServer: "https://10.0.0.1:6443",
+			wantUser:   map[string]string{"token": "", "password": "token"},
+			wantChanges: []Change{
+				{Rule: "#1", Kind: "user", Name: "admin", Field: "password", New: "<5 bytes>"},
+				{Rule: "#1", Kind: "user", Name: "admin", Field: "token", Old: "<5 bytes>"},
+			},
+		},
+		{
+			name:  "GlobalFirst",
+			label: "lab",
+			global: []map[string]interface{}{
+				{"name": "global", "set": map[string]interface{}{"namespace": "global"}},
+			},
+			rules:       []cfg.Rule{{Name: "source", Set: map[string]string{"namespace": "source"}}},
+			wantServer:  "https://10.0.0.1:6443",
+			wantContext: map[string]string{"namespace": "source"},
+			wantChanges: []Change{
+				{Rule: "global", Kind: "context", Name: "admin", Field: "namespace", New: "global"},
+				{Rule: "source", Kind: "context", Name: "admin", Field: "namespace", Old: "global", New: "source"},
+			},
+		},
+		{
+			name:    "Match",
+			label:   "prod-1",
+			profile: "k3s",
+			rules: []cfg.Rule{
+				{Name: "label", Label: "^lab", Set: map[string]string{"namespace": "lab"}},
+				{Name: "host", Host: `\.lab$`, Distribution: "^k3s$", Set: map[string]string{"tls-server-name": "kubernetes"}},
+				{Name: "distribution", Distribution: "^kubeadm$", Set: map[string]string{"proxy-url": "http://proxy:3128"}},
+			},
+			wantServer:  "https://10.0.0.1:6443",
+			wantCluster: map[string]string{"tls-server-name": "kubernetes", "proxy-url": ""},
+			wantContext: map[string]string{"namespace": ""},
+			wantChanges: []Change{
+				{Rule: "host", Kind: "cluster", Name: "admin", Field: "tls-server-name", New: "kubernetes"},
+			},
+		},
+		{
+			name:       "ApiAddress",
+			label:      "lab",
+			src:        cfg.Source{ApiAddress: "https://api.lab:6443"},
+			wantServer: "https://api.lab:6443",
+			wantChanges: []Change{
+				{Rule: "api-address", Kind: "cluster", Name: "admin", Field: "server", Old: "https://10.0.0.1:6443", New: "https://api.lab:6443"},
+			},
+		},
+		{
+			name:       "RewriteApi",
+			label:      "lab",
+			src:        cfg.Source{AutodetectApi: true, OverrideIp: "192.168.1.10", ApiAddress: "https://api.lab:6443"},
+			wantServer: "https://192.168.1.10:6443",
+			wantChanges: []Change{
+				{Rule: "rewrite-api", Kind: "cluster", Name: "admin", Field: "server", Old: "https://10.0.0.1:6443", New: "https://192.168.1.10:6443"},
+			},
+		},
+		{
+			name:       "RewriteApiPort",
+			label:      "lab",
+			src:        cfg.Source{AutodetectApi: true, OverrideIp: "fd00::1", OverridePort: "16443"},
+			wantServer: "https://[fd00::1]:16443",
+			wantChanges: []Change{
+				{Rule: "rewrite-api", Kind: "cluster", Name: "admin", Field: "server", Old: "https://10.0.0.1:6443", New: "https://[fd00::1]:16443"},
+			},
+		},
+		{
+			name:        "Insecure",
+			label:       "lab",
+			src:         cfg.Source{Insecure: true},
+			wantServer:  "https://10.0.0.1:6443",
+			wantCluster: map[string]string{"insecure-skip-tls-verify": "true", "certificate-authority-data": ""},
+			wantChanges: []Change{
+				{Rule: "insecure", Kind: "cluster", Name: "admin", Field: "insecure-skip-tls-verify", New: "true"},
+				{Rule: "insecure", Kind: "cluster", Name: "admin", Field: "certificate-authority-data", Old: "<2 bytes>"},
+			},
+		},
+		{
+			name:  "RulesAfterSettings",
+			label: "lab",
+			src:   cfg.Source{ApiAddress: "https://api.lab:6443", Insecure: true},
+			global: []map[string]interface{}{
+				{"name": "verify", "set": map[string]interface{}{"insecure-skip-tls-verify": "false"}},
+			},
+			rules:       []cfg.Rule{{Name: "vip", Set: map[string]string{"server": "https://vip.lab:6443"}}},
+			wantServer:  "https://vip.lab:6443",
+			wantCluster: map[string]string{"insecure-skip-tls-verify": ""},
+			wantChanges: []Change{
+				{Rule: "api-address", Kind: "cluster", Name: "admin", Field: "server", Old: "https://10.0.0.1:6443", New: "https://api.lab:6443"},
+				{Rule: "insecure", Kind: "cluster", Name: "admin", Field: "insecure-skip-tls-verify", New: "true"},
+				{Rule: "insecure", Kind: "cluster", Name: "admin", Field: "certificate-authority-data", Old: "<2 bytes>"},
+				{Rule: "verify", Kind: "cluster", Name: "admin", Field: "insecure-skip-tls-verify", Old: "true", New: "false"},
+				{Rule: "vip", Kind: "cluster", Name: "admin", Field: "server", Old: "https://api.lab:6443", New: "https://vip.lab:6443"},
+			},
+		},
+		{
+			name:    "UnknownField",
+			rules:   []cfg.Rule{{Unset: []string{"server-name"}}},
+			wantErr: true,
+		},
+		{
+			name:    "DropClusterField",
+			rules:   []cfg.Rule{{Drop: []string{"proxy-url"}}},
+			wantErr: true,
+		},
+		{
+			name:    "SetExec",
+			rules:   []cfg.Rule{{Set: map[string]string{"exec": "kubelogin"}}},
+			wantErr: true,
+		},
+		{
+			name:    "InvalidRegex",
+			rules:   []cfg.Rule{{Label: "("}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("rewrite", tt.global)
+			k := &KubeConfig{
+				Url:     &url.URL{Scheme: "ssh", Host: "node1.lab"},
+				Config:  testDistConfig("admin", "admin", "admin", "https://10.0.0.1:6443"),
+				Label:   tt.label,
+				Profile: tt.profile,
+				SrcDef:  tt.src,
+			}
+			k.SrcDef.Rewrite = tt.rules
+			err := k.Rewrite()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rewrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			cluster := k.Config.Clusters["admin"]
+			if cluster.Server != tt.wantServer {
+				t.Errorf("Rewrite() server = %v, want %v", cluster.Server, tt.wantServer)
+			}
+			for _, want := range []struct {
+				fields map[string]field
+				entry  interface{}
+				values map[string]string
+			}{
+				{ClusterFields, cluster, tt.wantCluster},
+				{ContextFields, k.Config.Contexts["admin"], tt.wantContext},
+				{UserFields, k.Config.AuthInfos["admin"], tt.wantUser},
+			} {
+				for name, value := range want.values {
+					if got := want.fields[name].get(want.entry); got != value {
+						t.Errorf("Rewrite() %s = %q, want %q", name, got, value)
+					}
+				}
+			}
+			if !reflect.DeepEqual(k.Changes, tt.wantChanges) {
+				t.Errorf("Rewrite() changes = %v, want %v", k.Changes, tt.wantChanges)
+			}
+		})
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []cfg.Rule
+		wantErr string
+	}{
+		{name: "Valid", rules: []cfg.Rule{{Set: map[string]string{"server": "https://{{.Host}}:6443"}}, {Unset: []string{"exec"}}}},
+		{name: "Settings", rules: settingRules(cfg.Source{AutodetectApi: true, OverrideIp: "10.0.0.1", Insecure: true})},
+		{name: "UnknownField", rules: []cfg.Rule{{Name: "proxy"}, {Set: map[string]string{"proxy": "http://proxy:3128"}}}, wantErr: "rewrite rule #2: unknown field"},
+		{name: "BadTemplate", rules: []cfg.Rule{{Name: "ns", Set: map[string]string{"namespace": "{{.Label"}}}, wantErr: "rewrite rule ns:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRules(tt.rules)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckRules() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("CheckRules() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKubeConfig_RewriteSettings(t *testing.T) {
+	tests := []struct {
+		name           string
+		src            cfg.Source
+		server         string
+		wantServers    map[string]string
+		wantInsecure   map[string]bool
+		wantApiAddress string
+		wantErr        bool
+	}{
+		{
+			name:           "ApiAddressCurrentContext",
+			src:            cfg.Source{ApiAddress: "https://api.lab:6443", Insecure: true},
+			wantServers:    map[string]string{"admin": "https://api.lab:6443", "other": "https://10.0.0.2:6443"},
+			wantInsecure:   map[string]bool{"admin": true, "other": false},
+			wantApiAddress: "https://api.lab:6443",
+		},
+		{
+			name:           "SelectedContexts",
+			src:            cfg.Source{AllContexts: true, ApiAddress: "https://api.lab:6443", Insecure: true},
+			wantServers:    map[string]string{"admin": "https://api.lab:6443", "other": "https://api.lab:6443"},
+			wantInsecure:   map[string]bool{"admin": true, "other": true},
+			wantApiAddress: "https://api.lab:6443",
+		},
+		{
+			name:           "RewriteApiSaved",
+			src:            cfg.Source{AutodetectApi: true, OverrideIp: "192.168.1.10"},
+			wantServers:    map[string]string{"admin": "https://192.168.1.10:6443", "other": "https://10.0.0.2:6443"},
+			wantApiAddress: "https://192.168.1.10:6443",
+		},
+		{
+			name:    "RewriteApiNoPort",
+			src:     cfg.Source{AutodetectApi: true, OverrideIp: "192.168.1.10"},
+			server:  "https://api.lab",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := tt.server
+			if server == "" {
+				server = "https://10.0.0.1:6443"
+			}
+			config := testDistConfig("admin", "admin", "admin", server)
+			config.Contexts["other"] = &clientcmdapi.Context{Cluster: "other", AuthInfo: "admin"}
+			config.Clusters["other"] = &clientcmdapi.Cluster{Server: "https://10.0.0.2:6443", CertificateAuthorityData: []byte("ca")}
+			k := &KubeConfig{Url: &url.URL{Scheme: "ssh", Host: "node1.lab"}, Config: config, Label: "lab", SrcDef: tt.src}
+			err := k.Rewrite()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rewrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for name, want := range tt.wantServers {
+				if got := k.Config.Clusters[name].Server; got != want {
+					t.Errorf("Rewrite() %s server = %q, want %q", name, got, want)
+				}
+			}
+			for name, want := range tt.wantInsecure {
+				if got := k.Config.Clusters[name].InsecureSkipTLSVerify; got != want {
+					t.Errorf("Rewrite() %s insecure = %v, want %v", name, got, want)
+				}
+				if got := k.Config.Clusters[name].CertificateAuthorityData == nil; got != want {
+					t.Errorf("Rewrite() %s CA removed = %v, want %v", name, got, want)
+				}
+			}
+			if k.SrcDef.ApiAddress != tt.wantApiAddress {
+				t.Errorf("Rewrite() saved api address = %q, want %q", k.SrcDef.ApiAddress, tt.wantApiAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubehttp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/secret"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultMaxRedirects is used when the source does not set MaxRedirects
+	DefaultMaxRedirects = 10
+	// DefaultTimeout is used when the source does not set Timeout
+	DefaultTimeout = 30 * time.Second
+	// MaxSize is the largest response accepted. Kubeconfig files are small.
+	MaxSize int64 = 10 << 20
+)
+
+func maxRedirects(src cfg.Source) int {
+	switch {
+	case src.MaxRedirects < 0:
+		return 0
+	case src.MaxRedirects == 0:
+		return DefaultMaxRedirects
+	}
+	return src.MaxRedirects
+}
+
+func newClient(src cfg.Source) (*http.Client, error) {
+	timeout := DefaultTimeout
+	if src.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(src.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse timeout: %q: %v", src.Timeout, err)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if src.CaFile != "" {
+		caFile, err := homedir.Expand(src.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to expand ca file: %q: %v", src.CaFile, err)
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file: %q", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	limit := maxRedirects(src)
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > limit {
+				return fmt.Errorf("stopped after %d redirects", limit)
+			}
+			log.Debugf("following redirect to: %s", req.URL.Redacted())
+			return nil
+		},
+	}, nil
+}
+
+// setAuth adds bearer or basic authentication to the request. The Authorization header
+// is dropped by the http client when a redirect leaves the original host.
+func setAuth(req *http.Request, src cfg.Source) error {
+	if src.Token != nil {
+		token, err := secret.Resolve(src.Token)
+		if err != nil {
+			return fmt.Errorf("unable to get token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	if src.Username != "" || src.Password != nil {
+		password := ""
+		if src.Password != nil {
+			var err error
+			password, err = secret.Resolve(src.Password)
+			if err != nil {
+				return fmt.Errorf("unable to get password: %v", err)
+			}
+		}
+		req.SetBasicAuth(src.Username, password)
+	}
+	return nil
+}
+
+// checkSha256 compares the content with the pinned hex encoded SHA-256, if there is one.
+func checkSha256(content []byte, pinned string) error {
+	if pinned == "" {
+		return nil
+	}
+	sum := sha256.Sum256(content)
+	got := hex.EncodeToString(sum[:])
+	if !strings.EqualFold(strings.TrimPrefix(pinned, "sha256:"), got) {
+		return fmt.Errorf("sha256 mismatch: got %s, expected %s", got, pinned)
+	}
+	return nil
+}
+
+// GetFile downloads the kubeconfig from an http(s) url.
+func GetFile(u *url.URL, src cfg.Source) ([]byte, error) {
+	client, err := newClient(src)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = setAuth(req, src)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("downloading: %s", u.Redacted())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s: %s", resp.Status, strings.TrimSpace(string(truncate(content, 200))))
+	}
+	if int64(len(content)) > MaxSize {
+		return nil, errors.New("response is larger than the maximum size")
+	}
+
+	err = checkSha256(content, src.Sha256)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("%d bytes downloaded\n", len(content))
+	return content, nil
+}
+
+func truncate(content []byte, size int) []byte {
+	if len(content) > size {
+		return content[:size]
+	}
+	return content
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubehttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const content = "kubeconfig content"
+
+func testServer(t *testing.T) (*httptest.Server, string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bearer", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sekrit" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, content)
+	})
+	mux.HandleFunc("/basic", func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "ci" || password != "sekrit" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, content)
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		count, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if count == 0 {
+			fmt.Fprint(w, content)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", count-1), http.StatusFound)
+	})
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err := ioutil.WriteFile(caFile, ca, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, caFile
+}
+
+func TestGetFile(t *testing.T) {
+	server, caFile := testServer(t)
+	os.Setenv("KHG_TEST_HTTP_SECRET", "sekrit")
+	defer os.Unsetenv("KHG_TEST_HTTP_SECRET")
+	sum := sha256.Sum256([]byte(content))
+	token := &cfg.Secret{Env: "KHG_TEST_HTTP_SECRET"}
+
+	tests := []struct {
+		name    string
+		path    string
+		src     cfg.Source
+		wantErr bool
+	}{
+		{
+			name: "Bearer",
+			path: "/bearer",
+			src:  cfg.Source{CaFile: caFile, Token: token},
+		},
+		{
+			name: "Basic",
+			path: "/basic",
+			src:  cfg.Source{CaFile: caFile, Username: "ci", Password: token},
+		},
+		{
+			name:    "Unauthorized",
+			path:    "/bearer",
+			src:     cfg.Source{CaFile: caFile},
+			wantErr: true,
+		},
+		{
+			name:    "UnknownCa",
+			path:    "/redirect/0",
+			src:     cfg.Source{},
+			wantErr: true,
+		},
+		{
+			name: "Redirects",
+			path: "/redirect/3",
+			src:  cfg.Source{CaFile: caFile, MaxRedirects: 3},
+		},
+		{
+			name:    "TooManyRedirects",
+			path:    "/redirect/3",
+			src:     cfg.Source{CaFile: caFile, MaxRedirects: 2},
+			wantErr: true,
+		},
+		{
+			name:    "NoRedirects",
+			path:    "/redirect/1",
+			src:     cfg.Source{CaFile: caFile, MaxRedirects: -1},
+			wantErr: true,
+		},
+		{
+			name: "Sha256",
+			path: "/redirect/0",
+			src:  cfg.Source{CaFile: caFile, Sha256: hex.EncodeToString(sum[:])},
+		},
+		{
+			name:    "Sha256Mismatch",
+			path:    "/redirect/0",
+			src:     cfg.Source{CaFile: caFile, Sha256: strings.Repeat("0", 64)},
+			wantErr: true,
+		},
+		{
+			name:    "NotFound",
+			path:    "/missing",
+			src:     cfg.Source{CaFile: caFile},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := GetFile(u, tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && string(got) != content {
+				t.Errorf("GetFile() got = %q, want %q", got, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesecret
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	capiGroup = "cluster.x-k8s.io"
+	// capiSecretType is the type of the secrets Cluster API creates, the kubeconfig is one of them
+	capiSecretType = "cluster.x-k8s.io/secret"
+	// metadataOnly asks the api server to leave the secret data out of the list
+	metadataOnly = "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1,application/json"
+)
+
+// Cluster is a Cluster API workload cluster with a kubeconfig secret.
+type Cluster struct {
+	Namespace string
+	Name      string
+	Phase     string
+	Secret    string
+}
+
+// Source returns the k8s-secret url of the kubeconfig of the cluster.
+func (c Cluster) Source(context string) string {
+	u := url.URL{
+		Scheme: "k8s-secret",
+		Path:   "/" + path.Join(c.Namespace, c.Secret),
+	}
+	query := url.Values{}
+	query.Set("key", DefaultKey)
+	if context != "" {
+		query.Set("context", context)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// CapiRef points to a management cluster: capi://<context>[/<namespace>]
+type CapiRef struct {
+	Context   string
+	Namespace string
+}
+
+// ParseCapiUrl parses a capi url. The context is handled the same way as for k8s-secret urls.
+func ParseCapiUrl(u *url.URL) (*CapiRef, error) {
+	ref := &CapiRef{
+		Context:   urlContext(u),
+		Namespace: strings.Trim(u.Path, "/"),
+	}
+	if strings.Contains(ref.Namespace, "/") {
+		return nil, fmt.Errorf("expected capi://<context>[/<namespace>], got: %q", u.String())
+	}
+	return ref, nil
+}
+
+type objectMeta struct {
+	Name              string `json:"name"`
+	Namespace         string `json:"namespace"`
+	DeletionTimestamp string `json:"deletionTimestamp,omitempty"`
+}
+
+type objectList struct {
+	Items []struct {
+		Metadata objectMeta `json:"metadata"`
+		Status   struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func namespaced(namespace string, resource string) string {
+	if namespace == "" {
+		return resource
+	}
+	return path.Join("namespaces", namespace, resource)
+}
+
+// ListClusters lists the Cluster API clusters of the management cluster that have a kubeconfig secret.
+// Clusters still provisioning or being deleted are skipped.
+func ListClusters(ref *CapiRef, src cfg.Source) ([]Cluster, error) {
+	client, err := newApiClient(ref.Context, src)
+	if err != nil {
+		return nil, err
+	}
+
+	group := struct {
+		PreferredVersion struct {
+			Version string `json:"version"`
+		} `json:"preferredVersion"`
+	}{}
+	err = client.get(path.Join("/apis", capiGroup), nil, "", &group)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the Cluster API group, is this a management cluster? %v", err)
+	}
+	version := group.PreferredVersion.Version
+	log.Debugf("using %s/%s", capiGroup, version)
+
+	clusters := objectList{}
+	err = client.get(path.Join("/apis", capiGroup, version, namespaced(ref.Namespace, "clusters")), nil, "", &clusters)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list clusters: %v", err)
+	}
+
+	secrets := objectList{}
+	query := url.Values{}
+	query.Set("fieldSelector", "type="+capiSecretType)
+	err = client.get(path.Join("/api/v1", namespaced(ref.Namespace, "secrets")), query, metadataOnly, &secrets)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list secrets: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, item := range secrets.Items {
+		found[item.Metadata.Namespace+"/"+item.Metadata.Name] = true
+	}
+
+	result := make([]Cluster, 0, len(clusters.Items))
+	for _, item := range clusters.Items {
+		c := Cluster{
+			Namespace: item.Metadata.Namespace,
+			Name:      item.Metadata.Name,
+			Phase:     item.Status.Phase,
+			Secret:    item.Metadata.Name + "-kubeconfig",
+		}
+		if item.Metadata.DeletionTimestamp != "" {
+			log.Infof("skipping cluster %s/%s: being deleted", c.Namespace, c.Name)
+			continue
+		}
+		if !found[c.Namespace+"/"+c.Secret] {
+			log.Infof("skipping cluster %s/%s: no kubeconfig secret yet (phase: %q)", c.Namespace, c.Name, c.Phase)
+			continue
+		}
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesecret
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"io/ioutil"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultKey is the secret key used by Cluster API
+	DefaultKey = "value"
+	// DefaultTimeout is used when the source does not set Timeout
+	DefaultTimeout = 30 * time.Second
+)
+
+// Ref points to a kubeconfig stored in a secret:
+// k8s-secret://<context>/<namespace>/<name>?key=value
+type Ref struct {
+	Context   string
+	Namespace string
+	Name      string
+	Key       string
+}
+
+// ParseUrl parses a k8s-secret url. Context names containing "@" (like "admin@cluster") parse as user info,
+// they are put back together. Contexts that are not valid host names can be set with ?context=.
+// An empty context means the current context.
+func ParseUrl(u *url.URL) (*Ref, error) {
+	ref := &Ref{
+		Context: urlContext(u),
+		Key:     u.Query().Get("key"),
+	}
+	if ref.Key == "" {
+		ref.Key = DefaultKey
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("expected k8s-secret://<context>/<namespace>/<name>, got: %q", u.String())
+	}
+	ref.Namespace, ref.Name = parts[0], parts[1]
+	return ref, nil
+}
+
+func urlContext(u *url.URL) string {
+	if context := u.Query().Get("context"); context != "" {
+		return context
+	}
+	if u.User != nil {
+		return u.User.String() + "@" + u.Host
+	}
+	return u.Host
+}
+
+// secret is the part of a v1.Secret we need
+type secret struct {
+	Data map[string][]byte `json:"data"`
+}
+
+// restConfig builds the client configuration for the context from the kubeconfig file.
+// The kubeconfig is the one set in the source or the destination.
+func restConfig(context string, src cfg.Source) (*rest.Config, error) {
+	fileName := src.Kubeconfig
+	if fileName == "" {
+		fileName = viper.GetString("destination")
+	}
+	fileName, err := homedir.Expand(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand kubeconfig path: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubeconfig: %v", err)
+	}
+	config, err := clientcmd.Load(content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse kubeconfig: %v: %v", fileName, err)
+	}
+	if context == "" {
+		context = config.CurrentContext
+	}
+	if _, ok := config.Contexts[context]; !ok {
+		return nil, fmt.Errorf("context %q not found in: %v", context, fileName)
+	}
+
+	log.Debugf("using context %q from: %q", context, fileName)
+	return clientcmd.NewNonInteractiveClientConfig(*config, context, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+}
+
+// apiClient is an http client for the api server of a context.
+type apiClient struct {
+	*http.Client
+	host *url.URL
+}
+
+func newApiClient(context string, src cfg.Source) (*apiClient, error) {
+	config, err := restConfig(context, src)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := DefaultTimeout
+	if src.Timeout != "" {
+		timeout, err = time.ParseDuration(src.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse timeout: %q: %v", src.Timeout, err)
+		}
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure api client: %v", err)
+	}
+	host, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse api server url: %q: %v", config.Host, err)
+	}
+	return &apiClient{Client: &http.Client{Transport: transport, Timeout: timeout}, host: host}, nil
+}
+
+// get decodes the json response for the api path into v.
+func (c *apiClient) get(apiPath string, query url.Values, accept string, v interface{}) error {
+	u := *c.host
+	u.Path = path.Join(u.Path, apiPath)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	log.Debugf("api request: %s", u.String())
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Code: resp.StatusCode, Message: apiMessage(body)}
+	}
+	return json.Unmarshal(body, v)
+}
+
+// StatusError is an error response from the api server.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// GetFile reads the kubeconfig from the secret key. The host of the api server used is returned as well.
+func GetFile(u *url.URL, src cfg.Source) (contents []byte, host string, err error) {
+	ref, err := ParseUrl(u)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := newApiClient(ref.Context, src)
+	if err != nil {
+		return nil, "", err
+	}
+
+	log.Debugf("reading secret: %s/%s from: %s", ref.Namespace, ref.Name, client.host.Host)
+	s := secret{}
+	err = client.get(path.Join("/api/v1/namespaces", ref.Namespace, "secrets", ref.Name), nil, "", &s)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to get secret %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	contents, ok := s.Data[ref.Key]
+	if !ok {
+		keys := make([]string, 0, len(s.Data))
+		for key := range s.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return nil, "", fmt.Errorf("key %q not found in secret %s/%s, available keys: %v", ref.Key, ref.Namespace, ref.Name, keys)
+	}
+	return contents, client.host.Hostname(), nil
+}
+
+// apiMessage returns the message of a Status response, or the body itself.
+func apiMessage(body []byte) string {
+	status := struct {
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(body, &status) == nil && status.Message != "" {
+		return status.Message
+	}
+	return strings.TrimSpace(string(body))
+}
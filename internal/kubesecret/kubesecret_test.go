@@ -0,0 +1,322 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesecret
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const workloadConfig = "kubeconfig content"
+
+type fakeSecret struct {
+	secretType string
+	data       map[string][]byte
+}
+
+type fakeCluster struct {
+	namespace string
+	name      string
+	phase     string
+	deleting  bool
+}
+
+type fakeApi struct {
+	// keyed by namespace/name
+	secrets  map[string]fakeSecret
+	clusters []fakeCluster
+}
+
+func writeNotFound(w http.ResponseWriter, resource string, name string) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"kind":"Status","message":"%s \"%s\" not found"}`, resource, name)
+}
+
+func metadata(namespace string, name string) map[string]interface{} {
+	return map[string]interface{}{"namespace": namespace, "name": name}
+}
+
+func (f *fakeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer management-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"kind":"Status","message":"Unauthorized"}`)
+		return
+	}
+
+	// the namespace is optional in list requests
+	apiPath := r.URL.Path
+	namespace := ""
+	parts := strings.Split(apiPath, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "namespaces" {
+			namespace = parts[i+1]
+			apiPath = strings.Join(append(parts[:i:i], parts[i+2:]...), "/")
+			break
+		}
+	}
+
+	items := make([]interface{}, 0)
+	switch {
+	case apiPath == "/apis/cluster.x-k8s.io":
+		if f.clusters == nil {
+			writeNotFound(w, "group", "cluster.x-k8s.io")
+			return
+		}
+		fmt.Fprint(w, `{"kind":"APIGroup","name":"cluster.x-k8s.io","preferredVersion":{"groupVersion":"cluster.x-k8s.io/v1beta1","version":"v1beta1"}}`)
+		return
+	case apiPath == "/apis/cluster.x-k8s.io/v1beta1/clusters":
+		for _, c := range f.clusters {
+			if namespace != "" && c.namespace != namespace {
+				continue
+			}
+			meta := metadata(c.namespace, c.name)
+			if c.deleting {
+				meta["deletionTimestamp"] = "2021-01-01T00:00:00Z"
+			}
+			items = append(items, map[string]interface{}{"metadata": meta, "status": map[string]string{"phase": c.phase}})
+		}
+	case apiPath == "/api/v1/secrets":
+		if r.URL.Query().Get("fieldSelector") != "type=cluster.x-k8s.io/secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for key, secret := range f.secrets {
+			keyParts := strings.SplitN(key, "/", 2)
+			if (namespace != "" && keyParts[0] != namespace) || secret.secretType != "cluster.x-k8s.io/secret" {
+				continue
+			}
+			items = append(items, map[string]interface{}{"metadata": metadata(keyParts[0], keyParts[1])})
+		}
+	case strings.HasPrefix(apiPath, "/api/v1/secrets/"):
+		name := strings.TrimPrefix(apiPath, "/api/v1/secrets/")
+		secret, ok := f.secrets[namespace+"/"+name]
+		if !ok {
+			writeNotFound(w, "secrets", name)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Secret", "data": secret.data})
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+// fakeApiServer serves the fake api to clients using the management token.
+func fakeApiServer(t *testing.T, api *fakeApi) *httptest.Server {
+	server := httptest.NewTLSServer(api)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testKubeconfig(t *testing.T, server *httptest.Server) string {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: management
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: admin
+  user:
+    token: management-token
+- name: nobody
+  user:
+    token: wrong
+contexts:
+- name: admin@management
+  context:
+    cluster: management
+    user: admin
+- name: nobody@management
+  context:
+    cluster: management
+    user: nobody
+current-context: admin@management
+`, server.URL, base64.StdEncoding.EncodeToString(ca))
+	fileName := filepath.Join(t.TempDir(), "config")
+	err := ioutil.WriteFile(fileName, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestGetFile(t *testing.T) {
+	server := fakeApiServer(t, &fakeApi{
+		secrets: map[string]fakeSecret{
+			"default/workload-kubeconfig": {data: map[string][]byte{"value": []byte(workloadConfig)}},
+			"team-a/vc-dev":               {data: map[string][]byte{"config": []byte(workloadConfig)}},
+		},
+	})
+	src := cfg.Source{Kubeconfig: testKubeconfig(t, server)}
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{
+			name: "ContextWithAt",
+			url:  "k8s-secret://admin@management/default/workload-kubeconfig",
+		},
+		{
+			name: "CurrentContext",
+			url:  "k8s-secret:///default/workload-kubeconfig",
+		},
+		{
+			name: "ContextParameter",
+			url:  "k8s-secret:///team-a/vc-dev?key=config&context=admin@management",
+		},
+		{
+			name:    "MissingKey",
+			url:     "k8s-secret:///team-a/vc-dev",
+			wantErr: true,
+		},
+		{
+			name:    "MissingSecret",
+			url:     "k8s-secret:///default/missing",
+			wantErr: true,
+		},
+		{
+			name:    "Unauthorized",
+			url:     "k8s-secret://nobody@management/default/workload-kubeconfig",
+			wantErr: true,
+		},
+		{
+			name:    "UnknownContext",
+			url:     "k8s-secret://other/default/workload-kubeconfig",
+			wantErr: true,
+		},
+		{
+			name:    "NoNamespace",
+			url:     "k8s-secret://admin@management/workload-kubeconfig",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := GetFile(u, src)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && string(got) != workloadConfig {
+				t.Errorf("GetFile() got = %q, want %q", got, workloadConfig)
+			}
+		})
+	}
+}
+
+func TestListClusters(t *testing.T) {
+	capiSecret := fakeSecret{secretType: "cluster.x-k8s.io/secret", data: map[string][]byte{"value": []byte(workloadConfig)}}
+	server := fakeApiServer(t, &fakeApi{
+		secrets: map[string]fakeSecret{
+			"default/prod-kubeconfig":    capiSecret,
+			"default/prod-ca":            capiSecret,
+			"team-a/dev-kubeconfig":      capiSecret,
+			"team-a/old-kubeconfig":      capiSecret,
+			"team-a/other-kubeconfig":    {data: map[string][]byte{"value": nil}},
+			"team-b/test-kubeconfig":     capiSecret,
+			"team-b/unrelated":           {data: map[string][]byte{"value": nil}},
+			"team-b/dangling-kubeconfig": capiSecret,
+		},
+		clusters: []fakeCluster{
+			{namespace: "default", name: "prod", phase: "Provisioned"},
+			{namespace: "team-a", name: "dev", phase: "Provisioned"},
+			{namespace: "team-a", name: "old", phase: "Deleting", deleting: true},
+			{namespace: "team-a", name: "other", phase: "Provisioned"},
+			{namespace: "team-a", name: "new", phase: "Provisioning"},
+			{namespace: "team-b", name: "test", phase: "Provisioned"},
+		},
+	})
+	noCapi := fakeApiServer(t, &fakeApi{})
+
+	tests := []struct {
+		name    string
+		server  *httptest.Server
+		url     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "AllNamespaces",
+			server: server,
+			url:    "capi://admin@management",
+			want:   []string{"default/prod-kubeconfig", "team-a/dev-kubeconfig", "team-b/test-kubeconfig"},
+		},
+		{
+			name:   "Namespace",
+			server: server,
+			url:    "capi:///team-a?context=admin@management",
+			want:   []string{"team-a/dev-kubeconfig"},
+		},
+		{
+			name:    "NotManagementCluster",
+			server:  noCapi,
+			url:     "capi://admin@management",
+			wantErr: true,
+		},
+		{
+			name:    "BadUrl",
+			server:  server,
+			url:     "capi://admin@management/team-a/dev",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := cfg.Source{Kubeconfig: testKubeconfig(t, tt.server)}
+			ref, err := ParseCapiUrl(u)
+			if err == nil {
+				var clusters []Cluster
+				clusters, err = ListClusters(ref, src)
+				got := make([]string, 0)
+				for _, c := range clusters {
+					got = append(got, c.Namespace+"/"+c.Secret)
+				}
+				if err == nil && !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ListClusters() got = %v, want %v", got, tt.want)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListClusters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/ssh_config"
+	"github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/secret"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefaultKeyPaths are tried, in order, when no identity is configured.
+	DefaultKeyPaths = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+	// Hard-coded default from library. Should open issue.
+	// github.com/kevinburke/ssh_config/validators.go:120
+	sshConfigDefaultIdentity = "~/.ssh/identity"
+
+	// sshConfigGet reads a keyword of the ssh_config of a host alias.
+	sshConfigGet = ssh_config.Get
+	// sshConfigGetAll reads every value of a multi-valued keyword, like IdentityFile. ssh_config.Get only returns the first one.
+	sshConfigGetAll = defaultSshConfigGetAll
+
+	// agent clients by socket, hosts can use different agents (IdentityAgent)
+	agentsLock sync.Mutex
+	agents     = make(map[string]agent.ExtendedAgent)
+
+	// decrypted keys are kept for the whole run so the passphrase is asked only once
+	decryptedLock sync.Mutex
+	decrypted     = make(map[string]ssh.Signer)
+)
+
+type identity struct {
+	path      string
+	raw       []byte
+	encrypted bool
+	signer    ssh.Signer
+	public    ssh.PublicKey
+}
+
+// encryptedSigner only asks for the passphrase once the server accepted the public key.
+type encryptedSigner struct {
+	id         *identity
+	passphrase *cfg.Secret
+}
+
+func (e *encryptedSigner) PublicKey() ssh.PublicKey {
+	return e.id.public
+}
+
+func (e *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := decryptIdentity(e.id, e.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+func decryptIdentity(id *identity, passphrase *cfg.Secret) (ssh.Signer, error) {
+	decryptedLock.Lock()
+	defer decryptedLock.Unlock()
+
+	if signer, ok := decrypted[id.path]; ok {
+		return signer, nil
+	}
+	value, err := secret.Get(passphrase, fmt.Sprintf("Enter passphrase for key '%s': ", id.path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get passphrase for key: %v: %v", id.path, err)
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(id.raw, []byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt key: %v: %v", id.path, err)
+	}
+	decrypted[id.path] = signer
+	return signer, nil
+}
+
+// defaultSshConfigGetAll reads the ssh_config files read by ssh_config.Get.
+func defaultSshConfigGetAll(alias string, key string) []string {
+	values := make([]string, 0)
+	values = append(values, sshConfigFileValues(filepath.Join(sshConfigHome(), ".ssh", "config"), false, alias, key, 0)...)
+	values = append(values, sshConfigFileValues("/etc/ssh/ssh_config", true, alias, key, 0)...)
+	return values
+}
+
+// sshConfigHome is the home directory used by ssh_config.Get.
+func sshConfigHome() string {
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir
+	}
+	return os.Getenv("HOME")
+}
+
+// sshConfigFileValues returns every value of the keyword matching the alias in the file and the files it includes.
+func sshConfigFileValues(fileName string, system bool, alias string, key string, depth int) []string {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	decoded, err := ssh_config.Decode(f)
+	f.Close()
+	if err != nil {
+		log.Warnf("unable to parse ssh config: %q: %v", fileName, err)
+		return nil
+	}
+	return sshConfigValues(decoded, system, alias, key, depth)
+}
+
+// sshConfigValues returns every value of the keyword in the hosts matching the alias, in order, following Include
+// like ssh does: relative paths are in ~/.ssh, or /etc/ssh for the system file.
+func sshConfigValues(config *ssh_config.Config, system bool, alias string, key string, depth int) []string {
+	values := make([]string, 0)
+	for _, host := range config.Hosts {
+		if !host.Matches(alias) {
+			continue
+		}
+		for _, node := range host.Nodes {
+			switch n := node.(type) {
+			case *ssh_config.KV:
+				if strings.EqualFold(n.Key, key) {
+					values = append(values, n.Value)
+				}
+			case *ssh_config.Include:
+				if depth >= maxIncludeDepth {
+					log.Warnf("ssh config includes nested too deep: %q", strings.TrimSpace(n.String()))
+					continue
+				}
+				for _, fileName := range includedFiles(n, system) {
+					values = append(values, sshConfigFileValues(fileName, system, alias, key, depth+1)...)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// maxIncludeDepth is the nesting of Include directives ssh_config accepts.
+const maxIncludeDepth = 5
+
+// includedFiles returns the files matching the patterns of the Include directive.
+// The directive only keeps its patterns in its string form.
+func includedFiles(include *ssh_config.Include, system bool) []string {
+	line := include.String()
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(strings.Replace(line, "=", " ", 1))
+	files := make([]string, 0)
+	for i, pattern := range fields {
+		if i == 0 {
+			// the Include keyword
+			continue
+		}
+		if strings.HasPrefix(pattern, "~/") {
+			pattern = filepath.Join(sshConfigHome(), pattern[2:])
+		} else if !filepath.IsAbs(pattern) && system {
+			pattern = filepath.Join("/etc/ssh", pattern)
+		} else if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(sshConfigHome(), ".ssh", pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Warnf("invalid ssh config include: %q: %v", pattern, err)
+			continue
+		}
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// expandTokens expands the ssh_config tokens that make sense for identity files.
+func expandTokens(value string, alias string, remoteUser string) string {
+	home, _ := homedir.Dir()
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", alias,
+		"%r", remoteUser,
+		"%u", localUser,
+	)
+	return replacer.Replace(value)
+}
+
+// identityFiles returns the identity files to try and whether any of them was explicitly configured.
+// The identity file of the source comes first.
+func identityFiles(alias string, remoteUser string, sourceKeyPath string) ([]string, bool) {
+	files := make([]string, 0)
+	if sourceKeyPath != "" {
+		files = append(files, sourceKeyPath)
+	}
+	cmdLineKeyPath := viper.GetString("identity")
+	if cmdLineKeyPath != "" {
+		files = append(files, cmdLineKeyPath)
+	}
+	for _, f := range sshConfigGetAll(alias, "IdentityFile") {
+		files = append(files, expandTokens(f, alias, remoteUser))
+	}
+	if len(files) == 0 {
+		if f := sshConfigGet(alias, "IdentityFile"); f != "" && f != sshConfigDefaultIdentity {
+			files = append(files, f)
+		}
+	}
+	explicit := len(files) > 0
+	if !explicit {
+		files = append(files, DefaultKeyPaths...)
+	}
+	return dedup(files), explicit
+}
+
+func dedup(values []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		result = append(result, v)
+	}
+	return result
+}
+
+func loadIdentity(path string) (*identity, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand key path: %v", err)
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &identity{path: path, raw: key}
+	if pubBytes, err := ioutil.ReadFile(path + ".pub"); err == nil {
+		if pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes); err == nil {
+			id.public = pub
+		}
+	}
+
+	id.signer, err = ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if id.public == nil && missing.PublicKey != nil {
+			id.public = missing.PublicKey
+		}
+		id.encrypted = true
+		return id, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %v: %v", path, err)
+	}
+	id.public = id.signer.PublicKey()
+	return id, nil
+}
+
+func agentSigners(alias string) ([]ssh.Signer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if identityAgent := sshConfigGet(alias, "IdentityAgent"); identityAgent != "" {
+		switch identityAgent {
+		case "none":
+			return nil, nil
+		case "SSH_AUTH_SOCK":
+		default:
+			expanded, err := expandHome(expandTokens(identityAgent, alias, ""))
+			if err != nil {
+				return nil, err
+			}
+			socket = os.ExpandEnv(expanded)
+		}
+	}
+	if socket == "" {
+		return nil, nil
+	}
+
+	client := agentFor(socket)
+	if client == nil {
+		return nil, nil
+	}
+	return client.Signers()
+}
+
+// agentFor returns the client of the agent listening on the socket, connecting the first time.
+// It is nil when the agent can not be reached.
+func agentFor(socket string) agent.ExtendedAgent {
+	agentsLock.Lock()
+	defer agentsLock.Unlock()
+	if client, ok := agents[socket]; ok {
+		return client
+	}
+	agents[socket] = nil
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Warnf("unable to connect to ssh agent: %q: %v", socket, err)
+		return nil
+	}
+	agents[socket] = agent.NewClient(conn)
+	return agents[socket]
+}
+
+// publicKeyAuth builds the public key auth method from the ssh agent and the identity files,
+// following the same rules as OpenSSH (including IdentitiesOnly).
+func publicKeyAuth(alias string, remoteUser string, identityFile string, passphrase *cfg.Secret) (ssh.AuthMethod, error) {
+	files, explicit := identityFiles(alias, remoteUser, identityFile)
+	identitiesOnly := strings.ToLower(sshConfigGet(alias, "IdentitiesOnly")) == "yes"
+
+	identities := make([]*identity, 0)
+	for _, f := range files {
+		id, err := loadIdentity(f)
+		if os.IsNotExist(err) {
+			log.Debugf("identity file not found: %q", f)
+			continue
+		}
+		if err != nil {
+			log.Warnf("skipping identity: %v", err)
+			continue
+		}
+		identities = append(identities, id)
+	}
+
+	signers := make([]ssh.Signer, 0)
+	fromAgent, err := agentSigners(alias)
+	if err != nil {
+		log.Warnf("unable to list ssh agent keys: %v", err)
+	}
+	for _, signer := range fromAgent {
+		if identitiesOnly && explicit && !hasPublicKey(identities, signer.PublicKey()) {
+			log.Debugf("IdentitiesOnly is set, skipping agent key: %s", ssh.FingerprintSHA256(signer.PublicKey()))
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	for _, id := range identities {
+		if id.public != nil && hasSigner(signers, id.public) {
+			continue
+		}
+		if !id.encrypted {
+			log.Debugf("using identity file: %q", id.path)
+			signers = append(signers, id.signer)
+			continue
+		}
+
+		if passphrase == nil && !secret.CanPrompt() {
+			log.Warnf("skipping passphrase protected key, no passphrase configured and no terminal: %q", id.path)
+			continue
+		}
+		if id.public == nil {
+			// without a public key we can only find out by decrypting it now
+			signer, err := decryptIdentity(id, passphrase)
+			if err != nil {
+				log.Warnf("skipping identity: %v", err)
+				continue
+			}
+			signers = append(signers, signer)
+			continue
+		}
+		log.Debugf("using passphrase protected identity file: %q", id.path)
+		signers = append(signers, &encryptedSigner{id: id, passphrase: passphrase})
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no usable ssh keys found in agent or identity files: %v", files)
+	}
+	return ssh.PublicKeys(signers...), nil
+}
+
+func hasPublicKey(identities []*identity, key ssh.PublicKey) bool {
+	for _, id := range identities {
+		if id.public != nil && bytes.Equal(id.public.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSigner(signers []ssh.Signer, key ssh.PublicKey) bool {
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
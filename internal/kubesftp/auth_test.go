@@ -0,0 +1,325 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/kevinburke/ssh_config"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/secret"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSshConfig writes ~/.ssh/config and reads ssh_config from it.
+func testSshConfig(t *testing.T, content string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(home, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(home, ".ssh", "config"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ssh_config.Decode(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshConfigGet = func(alias string, key string) string {
+		value, err := decoded.Get(alias, key)
+		if err != nil || value == "" {
+			return ssh_config.Default(key)
+		}
+		return value
+	}
+	sshConfigGetAll = func(alias string, key string) []string {
+		return sshConfigValues(decoded, false, alias, key, 0)
+	}
+	t.Cleanup(func() {
+		sshConfigGet = ssh_config.Get
+		sshConfigGetAll = defaultSshConfigGetAll
+	})
+}
+
+// testAgent serves an ssh agent holding a new key on a temporary socket.
+func testAgent(t *testing.T) (string, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		agentsLock.Lock()
+		delete(agents, socket)
+		agentsLock.Unlock()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	public, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return socket, public
+}
+
+func TestAgentSigners(t *testing.T) {
+	testSetup(t)
+	socketOne, keyOne := testAgent(t)
+	socketTwo, keyTwo := testAgent(t)
+	testSshConfig(t, "Host one\n  IdentityAgent "+socketOne+"\nHost two\n  IdentityAgent "+socketTwo+"\nHost none\n  IdentityAgent none\n")
+	os.Setenv("SSH_AUTH_SOCK", socketTwo)
+
+	tests := []struct {
+		name  string
+		alias string
+		want  []ssh.PublicKey
+	}{
+		{name: "IdentityAgent", alias: "one", want: []ssh.PublicKey{keyOne}},
+		{name: "OtherIdentityAgent", alias: "two", want: []ssh.PublicKey{keyTwo}},
+		{name: "FirstAgentAgain", alias: "one", want: []ssh.PublicKey{keyOne}},
+		{name: "None", alias: "none"},
+		{name: "SshAuthSock", alias: "other", want: []ssh.PublicKey{keyTwo}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signers, err := agentSigners(tt.alias)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(signers) != len(tt.want) {
+				t.Fatalf("agentSigners() got %d signers, want %d", len(signers), len(tt.want))
+			}
+			for i, signer := range signers {
+				if !bytes.Equal(signer.PublicKey().Marshal(), tt.want[i].Marshal()) {
+					t.Errorf("agentSigners() key %d = %s, want %s", i, ssh.FingerprintSHA256(signer.PublicKey()), ssh.FingerprintSHA256(tt.want[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestIdentityFiles(t *testing.T) {
+	testSetup(t)
+	viper.Set("identity", "")
+	included := filepath.Join(t.TempDir(), "included")
+	err := ioutil.WriteFile(included, []byte("Host inc\n  IdentityFile ~/id_included\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSshConfig(t, "Host only\n  IdentityFile ~/id_%r\n  IdentitiesOnly yes\nHost any\n  IdentityFile ~/id_test\n"+
+		"Host inc\n  IdentityFile ~/id_main\n  Include "+included+"\n")
+
+	tests := []struct {
+		name         string
+		alias        string
+		identityFile string
+		want         []string
+		wantExplicit bool
+	}{
+		{name: "IdentitiesOnly", alias: "only", want: []string{"~/id_tester"}, wantExplicit: true},
+		{name: "IdentitiesOnlySource", alias: "only", identityFile: "~/id_source", want: []string{"~/id_source", "~/id_tester"}, wantExplicit: true},
+		{name: "NoDefaults", alias: "any", want: []string{"~/id_test"}, wantExplicit: true},
+		{name: "NoDefaultsSource", alias: "other", identityFile: "~/id_source", want: []string{"~/id_source"}, wantExplicit: true},
+		{name: "Include", alias: "inc", want: []string{"~/id_main", "~/id_included"}, wantExplicit: true},
+		{name: "NotConfigured", alias: "other", want: DefaultKeyPaths},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, explicit := identityFiles(tt.alias, "tester", tt.identityFile)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("identityFiles() = %v, want %v", got, tt.want)
+			}
+			if explicit != tt.wantExplicit {
+				t.Errorf("identityFiles() explicit = %v, want %v", explicit, tt.wantExplicit)
+			}
+		})
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	testSetup(t)
+	viper.Set("identity", "")
+	socket, agentKey := testAgent(t)
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	// only the agent key is accepted, ~/id_test is not
+	target := newTestServer(t, agentKey)
+	fileName := testFile(t, "kubeconfig content")
+	host, port, err := net.SplitHostPort(target.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSshConfig(t, "Host agent\n  HostName "+host+"\n  IdentityFile ~/id_test\n"+
+		"Host only\n  HostName "+host+"\n  IdentityFile ~/id_test\n  IdentitiesOnly yes\n")
+
+	tests := []struct {
+		name    string
+		alias   string
+		wantErr bool
+	}{
+		{name: "Agent", alias: "agent"},
+		{name: "IdentitiesOnly", alias: "only", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse("ssh://tester@" + net.JoinHostPort(tt.alias, port) + fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, err := GetFile(u, cfg.Source{HostKeyPolicy: HostKeyAcceptNew})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != "kubeconfig content" {
+				t.Errorf("GetFile() got = %q", got)
+			}
+		})
+	}
+}
+
+// testEncryptedKey writes a passphrase protected key, with its public key next to it when withPublic is set.
+func testEncryptedKey(t *testing.T, passphrase string, withPublic bool) (string, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte(passphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_encrypted")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withPublic {
+		err = ioutil.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(public), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyPath, public
+}
+
+func TestEncryptedKeyAuth(t *testing.T) {
+	testSetup(t)
+	viper.Set("identity", "")
+	fileName := testFile(t, "kubeconfig content")
+	os.Setenv("KHG_TEST_PASSPHRASE", "sekrit")
+	os.Setenv("KHG_TEST_WRONG_PASSPHRASE", "wrong")
+	defer os.Unsetenv("KHG_TEST_PASSPHRASE")
+	defer os.Unsetenv("KHG_TEST_WRONG_PASSPHRASE")
+	other := testPublicKey(t)
+
+	tests := []struct {
+		name       string
+		withPublic bool
+		// the server accepts the key
+		accepted      bool
+		passphrase    *cfg.Secret
+		wantErr       bool
+		wantDecrypted bool
+	}{
+		{name: "Passphrase", withPublic: true, accepted: true, passphrase: &cfg.Secret{Env: "KHG_TEST_PASSPHRASE"}, wantDecrypted: true},
+		{name: "NoPublicKey", accepted: true, passphrase: &cfg.Secret{Env: "KHG_TEST_PASSPHRASE"}, wantDecrypted: true},
+		{name: "WrongPassphrase", withPublic: true, accepted: true, passphrase: &cfg.Secret{Env: "KHG_TEST_WRONG_PASSPHRASE"}, wantErr: true},
+		// the passphrase is not even read when the server does not accept the key
+		{name: "Lazy", withPublic: true, passphrase: &cfg.Secret{Env: "KHG_TEST_PASSPHRASE"}, wantErr: true},
+		// no passphrase and no terminal
+		{name: "Skipped", withPublic: true, accepted: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.passphrase == nil && secret.CanPrompt() {
+				t.Skip("the passphrase would be asked on the terminal")
+			}
+			keyPath, public := testEncryptedKey(t, "sekrit", tt.withPublic)
+			id, err := loadIdentity(keyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !id.encrypted {
+				t.Fatalf("loadIdentity() did not detect the passphrase protected key")
+			}
+			authorized := other
+			if tt.accepted {
+				authorized = public
+			}
+			target := newTestServer(t, authorized)
+
+			u, err := url.Parse("ssh://tester@" + target.address() + fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, err := GetFile(u, cfg.Source{HostKeyPolicy: HostKeyAcceptNew, IdentityFile: keyPath, Passphrase: tt.passphrase})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != "kubeconfig content" {
+				t.Errorf("GetFile() got = %q", got)
+			}
+			decryptedLock.Lock()
+			_, ok := decrypted[keyPath]
+			decryptedLock.Unlock()
+			if ok != tt.wantDecrypted {
+				t.Errorf("key decrypted = %v, want %v", ok, tt.wantDecrypted)
+			}
+		})
+	}
+}
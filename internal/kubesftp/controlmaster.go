@@ -0,0 +1,171 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/shell"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+// expandControlPath expands the ssh_config tokens of a ControlPath.
+func expandControlPath(path string, e *endpoint) string {
+	home, _ := homedir.Dir()
+	localUser, uid := "", ""
+	if u, err := user.Current(); err == nil {
+		localUser, uid = u.Username, u.Uid
+	}
+	localHost, _ := os.Hostname()
+	shortHost := localHost
+	if i := strings.Index(shortHost, "."); i >= 0 {
+		shortHost = shortHost[:i]
+	}
+	// same as OpenSSH: %C is the hash of %l%h%p%r%j
+	hash := sha1.Sum([]byte(localHost + e.host + e.port + e.user + sshConfigGet(e.alias, "ProxyJump")))
+
+	if strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%C", hex.EncodeToString(hash[:]),
+		"%d", home,
+		"%h", e.host,
+		"%i", uid,
+		"%L", shortHost,
+		"%l", localHost,
+		"%n", e.alias,
+		"%p", e.port,
+		"%r", e.user,
+		"%u", localUser,
+	).Replace(path)
+}
+
+// controlSocket returns the ControlPath of a running OpenSSH master connection to the endpoint.
+// Masters are only used when enabled with the controlmaster setting: the master of the target runs
+// the commands and sftp, the master of the first jump host reaches the next hop.
+func controlSocket(e *endpoint) (string, bool) {
+	if !viper.GetBool("controlmaster") {
+		return "", false
+	}
+	path := sshConfigGet(e.alias, "ControlPath")
+	if path == "" || path == "none" {
+		return "", false
+	}
+	path = expandControlPath(path, e)
+	if _, err := os.Stat(path); err != nil {
+		log.Debugf("no ControlMaster socket for %s: %v", e, err)
+		return "", false
+	}
+	err := exec.Command("ssh", "-S", path, "-O", "check", e.alias).Run()
+	if err != nil {
+		log.Debugf("ControlMaster for %s is not running: %q: %v", e, path, err)
+		return "", false
+	}
+	return path, true
+}
+
+// dialControlMaster connects to the next hop through the running OpenSSH master of the jump host,
+// without logging in to the jump host again.
+func dialControlMaster(socket string, master *endpoint, next *endpoint, config *ssh.ClientConfig) (*ssh.Client, error) {
+	command := fmt.Sprintf("ssh -o ControlMaster=no -S %s -W %s %s",
+		shell.Quote(socket), shell.Quote(next.address()), shell.Quote(master.alias))
+	log.Debugf("connecting to: %s using the ControlMaster of: %s", next, master)
+
+	conn, err := newProxyConn(command, next.address())
+	if err != nil {
+		return nil, fmt.Errorf("unable to use ControlMaster %q: %v", socket, err)
+	}
+	return newClient(conn, next, config)
+}
+
+// controlMaster runs the commands and sftp of a target with the ssh binary, through its running master.
+type controlMaster struct {
+	socket string
+	target *endpoint
+}
+
+// command returns ssh with the arguments, using the master and never asking anything.
+func (m *controlMaster) command(args ...string) *exec.Cmd {
+	return exec.Command("ssh", append([]string{"-o", "ControlMaster=no", "-o", "BatchMode=yes", "-S", m.socket}, args...)...)
+}
+
+func (m *controlMaster) alive() bool {
+	return m.command("-O", "check", m.target.alias).Run() == nil
+}
+
+func (m *controlMaster) session(command string) session {
+	return masterSession{m.command("-T", m.target.alias, command)}
+}
+
+// sftp starts the sftp subsystem of the target. The ssh process is stopped with the client.
+func (m *controlMaster) sftp(c *Client) (*sftp.Client, error) {
+	cmd := m.command("-T", "-s", m.target.alias, "sftp")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("starting sftp on: %s using the ControlMaster: %q", m.target, m.socket)
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		masterSession{cmd}.Close()
+		return nil, err
+	}
+	c.closers = append(c.closers, masterSession{cmd})
+	return client, nil
+}
+
+// masterSession is a command run by the ssh binary through a ControlMaster.
+type masterSession struct {
+	*exec.Cmd
+}
+
+func (s masterSession) setIO(stdin io.Reader, stdout io.Writer, stderr io.Writer) {
+	s.Stdin, s.Stdout, s.Stderr = stdin, stdout, stderr
+}
+
+func (s masterSession) StdoutPipe() (io.Reader, error) {
+	return s.Cmd.StdoutPipe()
+}
+
+// Close stops the ssh process if it was started and not waited for.
+func (s masterSession) Close() error {
+	if s.Process == nil || s.ProcessState != nil {
+		return nil
+	}
+	s.Process.Kill()
+	s.Cmd.Wait()
+	return nil
+}
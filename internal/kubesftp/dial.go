@@ -0,0 +1,446 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/shell"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxJumpDepth guards against ProxyJump loops in ssh_config
+const maxJumpDepth = 8
+
+// endpoint is one ssh hop, resolved through ssh_config.
+type endpoint struct {
+	alias string
+	host  string
+	port  string
+	user  string
+	// identity file of the source, tried before all the others
+	identityFile string
+	// password of the source, the terminal is asked when not set
+	password *cfg.Secret
+}
+
+func (e *endpoint) String() string {
+	return fmt.Sprintf("%s@%s:%s", e.user, e.host, e.port)
+}
+
+func (e *endpoint) address() string {
+	return net.JoinHostPort(e.host, e.port)
+}
+
+func newEndpoint(alias string, username string, port string) *endpoint {
+	e := &endpoint{
+		alias: alias,
+		user:  username,
+		port:  port,
+	}
+
+	if e.port == "" {
+		e.port = sshConfigGet(alias, "Port")
+	}
+	if host := sshConfigGet(alias, "HostName"); host != "" {
+		log.Debugf("ssh config HostName: %q", host)
+		e.host = strings.ReplaceAll(host, "%h", alias)
+	} else {
+		e.host = alias
+	}
+	if e.user == "" {
+		e.user = sshConfigGet(alias, "User")
+	}
+	if e.user == "" {
+		if u, err := user.Current(); err == nil {
+			e.user = u.Username
+		}
+	}
+	return e
+}
+
+func endpointFromUrl(u *url.URL) *endpoint {
+	return newEndpoint(u.Hostname(), u.User.Username(), u.Port())
+}
+
+// targetEndpoint is the endpoint of the source host. The user and port in the url win over the ones of the source.
+func targetEndpoint(u *url.URL, src cfg.Source) *endpoint {
+	username := u.User.Username()
+	if username == "" {
+		username = src.User
+	}
+	port := u.Port()
+	if port == "" && src.Port != 0 {
+		port = strconv.Itoa(src.Port)
+	}
+	e := newEndpoint(u.Hostname(), username, port)
+	e.identityFile = src.IdentityFile
+	e.password = src.SshPassword
+	return e
+}
+
+// parseJumps parses a ProxyJump style list: [user@]host[:port][,[user@]host[:port]...]
+func parseJumps(spec string) ([]*endpoint, error) {
+	jumps := make([]*endpoint, 0)
+	if spec == "" || spec == "none" {
+		return jumps, nil
+	}
+	for _, hop := range strings.Split(spec, ",") {
+		hop = strings.TrimSpace(hop)
+		if !strings.HasPrefix(hop, "ssh://") {
+			hop = "ssh://" + hop
+		}
+		u, err := url.Parse(hop)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse jump host: %q: %v", hop, err)
+		}
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("empty jump host in: %q", spec)
+		}
+		jumps = append(jumps, endpointFromUrl(u))
+	}
+	return jumps, nil
+}
+
+// Client is an ssh connection to the target host along with everything used to reach it.
+type Client struct {
+	*ssh.Client
+	Host string
+	Port string
+
+	closers []io.Closer
+	// the running OpenSSH master of the host, used instead of an ssh connection when set
+	master *controlMaster
+	// pooled clients are closed by ClosePool
+	pooled   bool
+	sftpLock sync.Mutex
+	sftp     *sftp.Client
+}
+
+// User returns the user logged in to the host.
+func (c *Client) User() string {
+	if c.master != nil {
+		return c.master.target.user
+	}
+	return c.Client.User()
+}
+
+// Close closes the connection, unless it is pooled.
+func (c *Client) Close() error {
+	if c.pooled {
+		return nil
+	}
+	return c.close()
+}
+
+func (c *Client) close() error {
+	c.sftpLock.Lock()
+	if c.sftp != nil {
+		c.sftp.Close()
+		c.sftp = nil
+	}
+	c.sftpLock.Unlock()
+	var err error
+	if c.Client != nil {
+		err = c.Client.Close()
+	}
+	c.closeAll()
+	return err
+}
+
+// Sftp returns the sftp session of the connection, started the first time. It is closed with the connection.
+func (c *Client) Sftp() (*sftp.Client, error) {
+	c.sftpLock.Lock()
+	defer c.sftpLock.Unlock()
+	if c.sftp == nil {
+		var client *sftp.Client
+		var err error
+		if c.master != nil {
+			client, err = c.master.sftp(c)
+		} else {
+			client, err = sftp.NewClient(c.Client)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to start sftp: %v", err)
+		}
+		c.sftp = client
+	}
+	return c.sftp, nil
+}
+
+// alive checks the connection with a keepalive request.
+func (c *Client) alive() bool {
+	if c.master != nil {
+		return c.master.alive()
+	}
+	_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+// Dial connects to the host in the url, going through jump hosts or a proxy command when configured.
+func Dial(u *url.URL, src cfg.Source) (*Client, error) {
+	target := targetEndpoint(u, src)
+
+	jumpSpec := src.Jump
+	if jumpSpec == "" {
+		jumpSpec = sshConfigGet(target.alias, "ProxyJump")
+	}
+	jumps, err := parseJumps(jumpSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	return pooled(poolKey(target, jumpSpec, src), func() (*Client, error) {
+		client := &Client{Host: target.host, Port: target.port}
+		if socket, ok := controlSocket(target); ok {
+			log.Debugf("using the ControlMaster of: %s", target)
+			client.master = &controlMaster{socket: socket, target: target}
+			return client, nil
+		}
+		sshClient, err := dialEndpoint(target, jumps, src, client, 0)
+		if err != nil {
+			client.closeAll()
+			return nil, err
+		}
+		client.Client = sshClient
+		return client, nil
+	})
+}
+
+// poolKey identifies a connection: the user, host and port, the route to the host
+// and the settings of the source used to log in.
+func poolKey(target *endpoint, jumpSpec string, src cfg.Source) string {
+	// the route: jump hosts, or the proxy command (which can use %r, %h, %p)
+	key := target.String() + " via " + jumpSpec
+	if jumpSpec == "" {
+		key += sshConfigGet(target.alias, "ProxyCommand")
+	}
+	password := ""
+	if src.SshPassword != nil {
+		password = fmt.Sprintf("%+v", *src.SshPassword)
+	}
+	return fmt.Sprintf("%s identity=%q password=%q hostkeypolicy=%q", key, src.IdentityFile, password, src.HostKeyPolicy)
+}
+
+func (c *Client) closeAll() {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i].Close()
+	}
+}
+
+func dialEndpoint(target *endpoint, jumps []*endpoint, src cfg.Source, client *Client, depth int) (*ssh.Client, error) {
+	if depth > maxJumpDepth {
+		return nil, fmt.Errorf("too many jump hosts, loop in ProxyJump configuration? at: %s", target)
+	}
+
+	config, err := loadSshConfig(target, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jumps) > 0 {
+		first := jumps[0]
+		hops := jumps[1:]
+		var via *ssh.Client
+		if socket, ok := controlSocket(first); ok {
+			// the running master of the first jump host reaches the next hop
+			next, nextConfig := target, config
+			if len(hops) > 0 {
+				next = hops[0]
+				nextConfig, err = loadSshConfig(next, src)
+				if err != nil {
+					return nil, err
+				}
+			}
+			via, err = dialControlMaster(socket, first, next, nextConfig)
+			if err != nil {
+				return nil, err
+			}
+			if len(hops) == 0 {
+				return via, nil
+			}
+			hops = hops[1:]
+		} else {
+			// the first jump host can have its own route in ssh_config
+			firstJumps, err := parseJumps(sshConfigGet(first.alias, "ProxyJump"))
+			if err != nil {
+				return nil, err
+			}
+			via, err = dialEndpoint(first, firstJumps, src, client, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, hop := range hops {
+			client.closers = append(client.closers, via)
+			hopConfig, err := loadSshConfig(hop, src)
+			if err != nil {
+				return nil, err
+			}
+			via, err = dialVia(via, hop, hopConfig)
+			if err != nil {
+				return nil, err
+			}
+		}
+		client.closers = append(client.closers, via)
+		return dialVia(via, target, config)
+	}
+
+	// a jump list from the source replaces the route from ssh_config
+	proxyCommand := sshConfigGet(target.alias, "ProxyCommand")
+	if (depth > 0 || src.Jump == "") && proxyCommand != "" && proxyCommand != "none" {
+		return dialProxyCommand(target, proxyCommand, config)
+	}
+
+	log.Debugf("connecting to: %s", target)
+	sshClient, err := ssh.Dial("tcp", target.address(), config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to: %s: %v", target, err)
+	}
+	return sshClient, nil
+}
+
+func dialVia(via *ssh.Client, target *endpoint, config *ssh.ClientConfig) (*ssh.Client, error) {
+	log.Debugf("connecting to: %s via: %s", target, via.RemoteAddr())
+	conn, err := via.Dial("tcp", target.address())
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to: %s through jump host %s: %v", target, via.RemoteAddr(), err)
+	}
+	return newClient(conn, target, config)
+}
+
+// newClient logs in over a connection from a ProxyCommand, a ControlMaster or a jump host.
+// They have no deadlines: the connection is closed, stopping the ProxyCommand, when the server does not answer
+// within the timeout of the config. Logging in, which can ask for passwords, is not limited.
+func newClient(conn net.Conn, target *endpoint, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var expired int32
+	answered := &answerConn{Conn: conn}
+	if config.Timeout > 0 {
+		answered.timer = time.AfterFunc(config.Timeout, func() {
+			atomic.StoreInt32(&expired, 1)
+			conn.Close()
+		})
+	}
+	c, chans, reqs, err := ssh.NewClientConn(answered, target.address(), config)
+	answered.stop()
+	if err != nil {
+		conn.Close()
+		if atomic.LoadInt32(&expired) == 1 {
+			return nil, fmt.Errorf("unable to connect to: %s: no answer after %v", target, config.Timeout)
+		}
+		return nil, fmt.Errorf("unable to connect to: %s: %v", target, err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// answerConn stops the timer once the server sent something.
+type answerConn struct {
+	net.Conn
+	timer *time.Timer
+}
+
+func (c *answerConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.stop()
+	}
+	return n, err
+}
+
+func (c *answerConn) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+func dialProxyCommand(target *endpoint, proxyCommand string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	command := strings.NewReplacer(
+		"%%", "%",
+		"%h", target.host,
+		"%n", target.alias,
+		"%p", target.port,
+		"%r", target.user,
+	).Replace(proxyCommand)
+	log.Debugf("connecting to: %s using ProxyCommand: %q", target, command)
+
+	conn, err := newProxyConn(command, target.address())
+	if err != nil {
+		return nil, fmt.Errorf("unable to start ProxyCommand: %q: %v", command, err)
+	}
+	return newClient(conn, target, config)
+}
+
+// proxyConn is a net.Conn over the standard input and output of a ProxyCommand.
+type proxyConn struct {
+	cmd    *exec.Cmd
+	reader io.ReadCloser
+	writer io.WriteCloser
+	addr   proxyAddr
+}
+
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "tcp" }
+func (a proxyAddr) String() string  { return string(a) }
+
+func newProxyConn(command string, address string) (*proxyConn, error) {
+	cmd := shell.Command(command)
+	cmd.Stderr = os.Stderr
+	writer, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{cmd: cmd, reader: reader, writer: writer, addr: proxyAddr(address)}, nil
+}
+
+func (p *proxyConn) Read(b []byte) (int, error)  { return p.reader.Read(b) }
+func (p *proxyConn) Write(b []byte) (int, error) { return p.writer.Write(b) }
+
+func (p *proxyConn) Close() error {
+	p.writer.Close()
+	if p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+	p.cmd.Wait()
+	return nil
+}
+
+func (p *proxyConn) LocalAddr() net.Addr                { return proxyAddr("127.0.0.1:0") }
+func (p *proxyConn) RemoteAddr() net.Addr               { return p.addr }
+func (p *proxyConn) SetDeadline(t time.Time) error      { return nil }
+func (p *proxyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (p *proxyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,185 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/secret"
+	"github.com/stefan-kiss/khg/internal/shell"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// CommandError is returned when a remote command exits with a non zero status.
+type CommandError struct {
+	Command    string
+	ExitStatus int
+	Stderr     string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("remote command %q exited with status %d: %s", e.Command, e.ExitStatus, e.Stderr)
+}
+
+func commandError(command string, err error, stderr *bytes.Buffer) error {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return &CommandError{
+			Command:    command,
+			ExitStatus: exitErr.ExitStatus(),
+			Stderr:     strings.TrimSpace(stderr.String()),
+		}
+	}
+	// the ssh binary exits with the status of the command run through a ControlMaster
+	var processErr *exec.ExitError
+	if errors.As(err, &processErr) {
+		return &CommandError{
+			Command:    command,
+			ExitStatus: processErr.ExitCode(),
+			Stderr:     strings.TrimSpace(stderr.String()),
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("remote command %q failed: %v", command, err)
+	}
+	return nil
+}
+
+// session is a command on the host: in an ssh session, or run by the ssh binary through a ControlMaster.
+type session interface {
+	// setIO sets the standard input and outputs, like the fields of ssh.Session
+	setIO(stdin io.Reader, stdout io.Writer, stderr io.Writer)
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.Reader, error)
+	Start() error
+	Wait() error
+	Close() error
+}
+
+// sshSession runs the command in an ssh session.
+type sshSession struct {
+	*ssh.Session
+	command string
+}
+
+func (s sshSession) setIO(stdin io.Reader, stdout io.Writer, stderr io.Writer) {
+	s.Stdin, s.Stdout, s.Stderr = stdin, stdout, stderr
+}
+
+func (s sshSession) Start() error {
+	return s.Session.Start(s.command)
+}
+
+// newSession prepares the command, it is started with Start.
+func (c *Client) newSession(command string) (session, error) {
+	if c.master != nil {
+		return c.master.session(command), nil
+	}
+	s, err := c.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open ssh session: %v", err)
+	}
+	return sshSession{Session: s, command: command}, nil
+}
+
+// runCommand runs the command in a new session and returns its standard output.
+func runCommand(conn *Client, command string, stdin io.Reader) ([]byte, error) {
+	session, err := conn.newSession(command)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.setIO(stdin, &stdout, &stderr)
+
+	log.Debugf("running remote command: %q", command)
+	err = session.Start()
+	if err == nil {
+		err = session.Wait()
+	}
+	return stdout.Bytes(), commandError(command, err, &stderr)
+}
+
+func sudoNeedsPassword(err error) bool {
+	var cmdErr *CommandError
+	return errors.As(err, &cmdErr) && strings.Contains(cmdErr.Stderr, "password is required")
+}
+
+// withSudo calls run with the sudo prefix for the command and what has to be written to its standard input first.
+// Without a configured password a non interactive sudo is tried first and the password is only asked
+// on the terminal if sudo needs one.
+func withSudo(client *Client, src cfg.Source, run func(prefix string, stdin []byte) ([]byte, error)) ([]byte, error) {
+	if src.SudoPassword == nil {
+		out, err := run("sudo -n ", nil)
+		if err == nil || !sudoNeedsPassword(err) || !secret.CanPrompt() {
+			return out, err
+		}
+	}
+
+	password, err := secret.Get(src.SudoPassword, fmt.Sprintf("[sudo] password for %s@%s: ", client.User(), client.Host))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get sudo password: %v", err)
+	}
+	return run("sudo -S -p '' ", []byte(password+"\n"))
+}
+
+// sourceCommand returns the command of the source, or the one from the cmd url parameter.
+func sourceCommand(u *url.URL, src cfg.Source) (string, error) {
+	if src.Command != "" {
+		return src.Command, nil
+	}
+	if command := u.Query().Get("cmd"); command != "" {
+		return command, nil
+	}
+	return "", fmt.Errorf("no command configured for source: %q", u.Redacted())
+}
+
+// GetCommandOutput runs the command of the source on the host from the url and returns its standard output.
+func GetCommandOutput(u *url.URL, src cfg.Source) (contents []byte, host string, port string, err error) {
+	command, err := sourceCommand(u, src)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	conn, err := Dial(u, src)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer conn.Close()
+
+	if src.Sudo {
+		contents, err = withSudo(conn, src, func(prefix string, stdin []byte) ([]byte, error) {
+			return runCommand(conn, prefix+"sh -c "+shell.Quote(command), bytes.NewReader(stdin))
+		})
+	} else {
+		contents, err = runCommand(conn, command, nil)
+	}
+	if err != nil {
+		// the CommandError already names the command, keep it for callers checking the exit status
+		return nil, "", "", err
+	}
+
+	log.Infof("%d bytes read from command output\n", len(contents))
+	return contents, conn.Host, conn.Port, nil
+}
@@ -0,0 +1,354 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/secret"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Host key policies. An empty policy means the StrictHostKeyChecking value from ssh_config is used.
+const (
+	HostKeyStrict    = "strict"
+	HostKeyAsk       = "ask"
+	HostKeyAcceptNew = "accept-new"
+	HostKeyReplace   = "replace"
+)
+
+// known_hosts files are shared between all the connections of a run
+var knownHostsLock sync.Mutex
+
+type hostKeyChecker struct {
+	policy     string
+	hashHosts  bool
+	userFiles  []string
+	otherFiles []string
+}
+
+func expandHome(path string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", fmt.Errorf("path %q contains \"~\" and unable to find home dir: %v", path, err)
+		}
+		return filepath.Join(home, path[2:]), nil
+	}
+	return path, nil
+}
+
+func knownHostsFiles(alias string, key string) ([]string, error) {
+	files := make([]string, 0)
+	for _, f := range strings.Fields(sshConfigGet(alias, key)) {
+		expanded, err := expandHome(f)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, expanded)
+	}
+	return files, nil
+}
+
+func hostKeyPolicy(alias string, policy string) (string, error) {
+	switch policy {
+	case HostKeyStrict, HostKeyAsk, HostKeyAcceptNew, HostKeyReplace:
+		return policy, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown host key policy: %q", policy)
+	}
+
+	strict := strings.ToLower(sshConfigGet(alias, "StrictHostKeyChecking"))
+	switch strict {
+	case "yes":
+		return HostKeyStrict, nil
+	case "accept-new", "no", "off":
+		return HostKeyAcceptNew, nil
+	default:
+		return HostKeyAsk, nil
+	}
+}
+
+// hostKeyAlgorithms are the host key algorithms of x/crypto/ssh, in its order of preference.
+var hostKeyAlgorithms = []string{
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	ssh.KeyAlgoED25519,
+}
+
+// newHostKeyChecker verifies host keys against the known_hosts files configured for the ssh_config alias.
+func newHostKeyChecker(alias string, policy string) (*hostKeyChecker, error) {
+	var err error
+	checker := &hostKeyChecker{}
+
+	checker.policy, err = hostKeyPolicy(alias, policy)
+	if err != nil {
+		return nil, err
+	}
+	checker.hashHosts = strings.ToLower(sshConfigGet(alias, "HashKnownHosts")) == "yes"
+
+	checker.userFiles, err = knownHostsFiles(alias, "UserKnownHostsFile")
+	if err != nil {
+		return nil, err
+	}
+	if len(checker.userFiles) == 0 {
+		return nil, fmt.Errorf("no UserKnownHostsFile configured for: %q", alias)
+	}
+	checker.otherFiles, err = knownHostsFiles(alias, "GlobalKnownHostsFile")
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("host key policy: %q, known hosts: %v", checker.policy, checker.userFiles)
+	return checker, nil
+}
+
+// probeKey has a key type no known_hosts entry has: looking it up returns all the keys known for the host.
+type probeKey struct{}
+
+func (probeKey) Type() string                            { return "khg-probe" }
+func (probeKey) Marshal() []byte                         { return []byte("khg-probe") }
+func (probeKey) Verify(_ []byte, _ *ssh.Signature) error { return errors.New("probe key") }
+
+// algorithms returns the host key algorithms offered to the host: the types of the keys known for it first, like ssh does,
+// so a host known by one of its keys is not asked for another one. Nil, the default order, when no key is known.
+func (h *hostKeyChecker) algorithms(hostname string) []string {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	var keyErr *knownhosts.KeyError
+	// the remote address is not known yet, the entries of the hostname are used
+	err := h.lookup(hostname, &net.TCPAddr{}, probeKey{})
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, want := range keyErr.Want {
+		known[want.Key.Type()] = true
+	}
+	algorithms := make([]string, 0, len(hostKeyAlgorithms))
+	for _, algorithm := range hostKeyAlgorithms {
+		if known[algorithm] {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	for _, algorithm := range hostKeyAlgorithms {
+		if !known[algorithm] {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	log.Debugf("host key algorithms for %q: %v", hostname, algorithms)
+	return algorithms
+}
+
+func (h *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	err := h.lookup(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	// a key of another type than the known ones is a new key, not a changed one
+	changed := false
+	for _, want := range keyErr.Want {
+		if want.Key.Type() == key.Type() {
+			changed = true
+		}
+	}
+	if changed {
+		if h.policy != HostKeyReplace {
+			return fmt.Errorf("host key for %q has changed (%s %s). known key in %s:%d. use host key policy %q to replace it",
+				hostname, key.Type(), fingerprint, keyErr.Want[0].Filename, keyErr.Want[0].Line, HostKeyReplace)
+		}
+		log.Warnf("host key for %q has changed. replacing it with: %s %s", hostname, key.Type(), fingerprint)
+		err = h.remove(hostname, remote)
+		if err != nil {
+			return fmt.Errorf("unable to remove old host key for %q: %v", hostname, err)
+		}
+		return h.add(hostname, key)
+	}
+
+	if len(keyErr.Want) > 0 {
+		log.Warnf("%q offered a %s host key, only keys of other types are known for it in %s:%d", hostname, key.Type(), keyErr.Want[0].Filename, keyErr.Want[0].Line)
+	}
+	switch h.policy {
+	case HostKeyStrict:
+		return fmt.Errorf("no host key is known for %q (%s %s) and strict host key checking is enabled", hostname, key.Type(), fingerprint)
+	case HostKeyAsk:
+		if !confirmHostKey(hostname, key) {
+			return fmt.Errorf("host key verification failed for %q", hostname)
+		}
+	default:
+		log.Warnf("permanently adding %q (%s %s) to the list of known hosts", hostname, key.Type(), fingerprint)
+	}
+	return h.add(hostname, key)
+}
+
+func (h *hostKeyChecker) lookup(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	files := make([]string, 0)
+	for _, f := range append(h.userFiles, h.otherFiles...) {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return &knownhosts.KeyError{}
+	}
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return fmt.Errorf("unable to read known hosts files: %v: %v", files, err)
+	}
+	return callback(hostname, remote, key)
+}
+
+func (h *hostKeyChecker) add(hostname string, key ssh.PublicKey) error {
+	address := knownhosts.Normalize(hostname)
+	if h.hashHosts {
+		address = knownhosts.HashHostname(address)
+	}
+	line := knownhosts.Line([]string{address}, key)
+
+	fileName := h.userFiles[0]
+	err := os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return fmt.Errorf("unable to create known hosts directory: %v", err)
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open known hosts file: %v: %v", fileName, err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(line + "\n")
+	if err != nil {
+		return fmt.Errorf("unable to write known hosts file: %v: %v", fileName, err)
+	}
+	return nil
+}
+
+// remove drops every entry for the host (and the address it resolved to) from the user known_hosts files.
+func (h *hostKeyChecker) remove(hostname string, remote net.Addr) error {
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if tcpAddr, ok := remote.(*net.TCPAddr); ok {
+		addresses = append(addresses, knownhosts.Normalize(tcpAddr.String()))
+	}
+
+	for _, fileName := range h.userFiles {
+		content, err := ioutil.ReadFile(fileName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var kept bytes.Buffer
+		removed := 0
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			_, hosts, _, _, _, err := ssh.ParseKnownHosts(line)
+			if err == nil && matchesAny(hosts, addresses) {
+				removed++
+				continue
+			}
+			kept.Write(line)
+			kept.WriteByte('\n')
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if removed == 0 {
+			continue
+		}
+
+		log.Debugf("removing %d known hosts entries from: %q", removed, fileName)
+		err = ioutil.WriteFile(fileName, kept.Bytes(), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchesAny(hosts []string, addresses []string) bool {
+	for _, host := range hosts {
+		for _, address := range addresses {
+			if matchHost(host, address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchHost matches literal and hashed known_hosts entries. Wildcard patterns are never removed.
+func matchHost(host string, address string) bool {
+	if !strings.HasPrefix(host, "|1|") {
+		return host == address
+	}
+	parts := strings.Split(host, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(address))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+func confirmHostKey(hostname string, key ssh.PublicKey) bool {
+	prompt := fmt.Sprintf("The authenticity of host %q can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+		hostname, key.Type(), ssh.FingerprintSHA256(key))
+	answer, err := secret.Ask(prompt)
+	if err != nil {
+		log.Errorf("no host key is known for %q and unable to ask for confirmation: %v", hostname, err)
+		return false
+	}
+	return strings.ToLower(answer) == "yes"
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public
+}
+
+func testEd25519Key(t *testing.T) ssh.PublicKey {
+	key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public
+}
+
+// unhash replaces the hashed entries of the address with literal ones.
+func unhash(t *testing.T, content string, address string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if line == "" {
+			continue
+		}
+		_, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			t.Fatalf("invalid known_hosts line: %q: %v", line, err)
+		}
+		if matchesAny(hosts, []string{address}) {
+			line = knownhosts.Line([]string{address}, key) + "\n"
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+func TestHostKeys(t *testing.T) {
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	fileName := testFile(t, "kubeconfig content")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+
+	address := knownhosts.Normalize(target.address())
+	oldKey := testPublicKey(t)
+	unrelated := knownhosts.Line([]string{"other.example.com"}, oldKey) + "\n"
+	known := unrelated + knownhosts.Line([]string{address}, oldKey) + "\n"
+	hashed := unrelated + knownhosts.Line([]string{knownhosts.HashHostname(address)}, oldKey) + "\n"
+	added := knownhosts.Line([]string{address}, target.hostKey) + "\n"
+	knownEd25519 := unrelated + knownhosts.Line([]string{address}, target.ed25519HostKey) + "\n"
+	otherEd25519 := unrelated + knownhosts.Line([]string{address}, testEd25519Key(t)) + "\n"
+
+	tests := []struct {
+		name       string
+		policy     string
+		knownHosts string
+		want       string
+		wantErr    bool
+	}{
+		{name: "ChangedStrict", policy: HostKeyStrict, knownHosts: known, want: known, wantErr: true},
+		{name: "ChangedAcceptNew", policy: HostKeyAcceptNew, knownHosts: known, want: known, wantErr: true},
+		{name: "ChangedReplace", policy: HostKeyReplace, knownHosts: known, want: unrelated + added},
+		{name: "HashedChangedStrict", policy: HostKeyStrict, knownHosts: hashed, want: hashed, wantErr: true},
+		{name: "HashedReplace", policy: HostKeyReplace, knownHosts: hashed, want: unrelated + added},
+		{name: "UnknownStrict", policy: HostKeyStrict, knownHosts: unrelated, want: unrelated, wantErr: true},
+		{name: "UnknownAcceptNew", policy: HostKeyAcceptNew, knownHosts: unrelated, want: unrelated + added},
+		{name: "Known", policy: HostKeyStrict, knownHosts: unrelated + added, want: unrelated + added},
+		{name: "KnownEd25519Strict", policy: HostKeyStrict, knownHosts: knownEd25519, want: knownEd25519},
+		{name: "KnownEd25519Replace", policy: HostKeyReplace, knownHosts: knownEd25519, want: knownEd25519},
+		{name: "ChangedEd25519Strict", policy: HostKeyStrict, knownHosts: otherEd25519, want: otherEd25519, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := os.MkdirAll(filepath.Dir(knownHosts), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(knownHosts, []byte(tt.knownHosts), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse("ssh://tester@" + target.address() + fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, _, err = GetFile(u, cfg.Source{HostKeyPolicy: tt.policy})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, err := ioutil.ReadFile(knownHosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// HashKnownHosts can be set in the system ssh_config
+			if unhash(t, string(got), address) != unhash(t, tt.want, address) {
+				t.Errorf("known_hosts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	address := "[10.0.0.1]:2222"
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{name: "Literal", host: address, want: true},
+		{name: "OtherLiteral", host: "[10.0.0.1]:22", want: false},
+		{name: "Hashed", host: knownhosts.HashHostname(address), want: true},
+		{name: "OtherHashed", host: knownhosts.HashHostname("10.0.0.1"), want: false},
+		{name: "BrokenHash", host: "|1|not base64|", want: false},
+		{name: "Wildcard", host: "[10.0.0.*]:2222", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchHost(tt.host, address); got != tt.want {
+				t.Errorf("matchHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHostKeyChecker_OtherType checks that a key of a type not known for the host is a new key, not a changed one.
+func TestHostKeyChecker_OtherType(t *testing.T) {
+	testSetup(t)
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+	hostname := "node1.lab:22"
+	known := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, testEd25519Key(t)) + "\n"
+	offered := testPublicKey(t)
+
+	tests := []struct {
+		name    string
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{name: "Strict", policy: HostKeyStrict, want: known, wantErr: true},
+		{name: "Replace", policy: HostKeyReplace, want: known + knownhosts.Line([]string{knownhosts.Normalize(hostname)}, offered) + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := os.MkdirAll(filepath.Dir(knownHosts), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(knownHosts, []byte(known), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checker, err := newHostKeyChecker("node1.lab", tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := checker.algorithms(hostname); len(got) == 0 || got[0] != ssh.KeyAlgoED25519 {
+				t.Errorf("algorithms() = %v, want %s first", got, ssh.KeyAlgoED25519)
+			}
+			err = checker.check(hostname, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}, offered)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), "changed") {
+				t.Errorf("check() error = %v, want an unknown host key", err)
+			}
+			got, err := ioutil.ReadFile(knownHosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := knownhosts.Normalize(hostname)
+			if unhash(t, string(got), address) != unhash(t, tt.want, address) {
+				t.Errorf("known_hosts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
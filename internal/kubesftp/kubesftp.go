@@ -16,154 +16,138 @@
 package kubesftp
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"github.com/kevinburke/ssh_config"
-	"github.com/mitchellh/go-homedir"
-	"github.com/pkg/sftp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
 	"golang.org/x/crypto/ssh"
-	"io"
-	"io/ioutil"
 	"net/url"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
 )
 
-var (
-	DefaultKeyPath = "~/.ssh/id_rsa"
-)
+// connectTimeout limits connecting to a host, until it answers.
+var connectTimeout = 5 * time.Second
 
-func publicKey(path string) (ssh.AuthMethod, error) {
-	if strings.HasPrefix(path, "~/") {
-		home, err := homedir.Dir()
-		if err != nil {
-			return nil, fmt.Errorf("key path contains \"~\" and unable to find home dir: %v", err)
-		}
-		path = filepath.Join(home, path[2:])
+func loadSshConfig(e *endpoint, src cfg.Source) (sshConfig *ssh.ClientConfig, err error) {
+	auth := make([]ssh.AuthMethod, 0)
+	passwords := passwordAuth(e)
+	key, err := publicKeyAuth(e.alias, e.user, e.identityFile, src.Passphrase)
+	if err != nil && len(passwords) == 0 {
+		return nil, fmt.Errorf("unable to load ssh keys: %v", err)
 	}
-	key, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read key path: %v: %v", path, err)
-	}
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("parse private key: %v: %v", path, err)
-	}
-	return ssh.PublicKeys(signer), nil
-}
-
-func LoadSshConfig(url *url.URL) (host string, port string, sshConfig *ssh.ClientConfig, err error) {
-	var username string
-	var urlHostName string
-
-	hostPort := strings.Split(url.Host, ":")
-	if len(hostPort) < 2 {
-		port = ssh_config.Get(url.Host, "Port")
-	} else {
-		port = hostPort[1]
-	}
-	urlHostName = hostPort[0]
-
-	if host = ssh_config.Get(urlHostName, "HostName"); host != "" {
-		log.Debugf("ssh config HostName: %q", host)
+		log.Debugf("no public key auth for %s, trying password: %v", e, err)
 	} else {
-		host = hostPort[0]
+		auth = append(auth, key)
 	}
+	auth = append(auth, passwords...)
 
-	if url.User.Username() != "" {
-		username = url.User.Username()
-	} else {
-		username = ssh_config.Get(url.Host, "User")
-	}
-
-	var keyPath string
-	cmdLineKeyPath := viper.GetString("identity")
-	if cmdLineKeyPath != "" {
-		keyPath = cmdLineKeyPath
-	} else {
-		keyPath = ssh_config.Get(url.Host, "IdentityFile")
-		// Hard-coded default from library. Should open issue.
-		// github.com/kevinburke/ssh_config/validators.go:120
-		if keyPath == "~/.ssh/identity" {
-			keyPath = DefaultKeyPath
-		}
-	}
-
-	key, err := publicKey(keyPath)
+	hostKeys, err := newHostKeyChecker(e.alias, src.HostKeyPolicy)
 	if err != nil {
-		return "", "", nil, fmt.Errorf("unable to load private key: %v", err)
+		return nil, fmt.Errorf("unable to load known hosts: %v", err)
 	}
+
 	sshConfig = &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			key,
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         5 * time.Second,
-	}
-	log.Debugf("host: %s:%s, config: %#v", host, port, sshConfig)
-	return host, port, sshConfig, nil
+		User:              e.user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys.check,
+		HostKeyAlgorithms: hostKeys.algorithms(e.address()),
+		Timeout:           connectTimeout,
+	}
+	log.Debugf("host: %s, config: %#v", e, sshConfig)
+	return sshConfig, nil
 }
 
-func GetFile(url *url.URL) (contents []byte, host string, port string, err error) {
-
-	var fileName string
-	log.Debugf("url: %#v", url)
-
+// remotePath returns the path from the url as it should be used on the remote host.
+// Relative paths are relative to the user's home.
+func remotePath(url *url.URL) (string, error) {
 	if url.Host != "" && url.Path == "" {
 		url.Path = viper.GetString("defaultsourcepath")
 		log.Debugf("empty path, using default: %q", url.Path)
 	}
 
 	if url.Path == "" {
-		log.Fatalf("unable to determine source path: empty string")
+		return "", fmt.Errorf("unable to determine source path: empty string")
 	}
 
 	if strings.HasPrefix(url.Path, "/./") || strings.HasPrefix(url.Path, "/~/") {
-		fileName = url.Path[3:]
+		return url.Path[3:], nil
 	} else if strings.HasPrefix(url.Path, "./") || strings.HasPrefix(url.Path, "~/") {
-		fileName = url.Path[2:]
-	} else {
-		fileName = url.Path
+		return url.Path[2:], nil
 	}
+	return url.Path, nil
+}
 
-	host, port, config, err := LoadSshConfig(url)
+// GetFile reads the kube configuration from the url path. Without a path the known locations
+// are probed, see ProbeFile.
+func GetFile(url *url.URL, src cfg.Source) (contents []byte, host string, port string, err error) {
+	log.Debugf("url: %#v", url)
+	if url.Host != "" && url.Path == "" {
+		contents, host, port, _, err = ProbeFile(url, src)
+		return contents, host, port, err
+	}
 
-	// host
-	log.Debugf("connecting to: %q", host)
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", host, port), config)
+	fileName, err := remotePath(url)
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", "", err
+	}
+
+	conn, err := Dial(url, src)
+	if err != nil {
+		return nil, "", "", err
 	}
 	defer conn.Close()
+	host, port = conn.Host, conn.Port
+
+	contents, err = readFile(conn, fileName, src)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("unable to read %q from %s: %v", fileName, conn.Host, err)
+	}
 
-	// create new SFTP client
-	client, err := sftp.NewClient(conn)
+	log.Infof("%d bytes copied\n", len(contents))
+	return contents, host, port, nil
+}
+
+// Glob returns the files on the host matching the path of the url. A path ending with "/" lists the regular files
+// in the directory, hidden ones excepted. Relative paths are returned relative to the user's home.
+func Glob(u *url.URL, src cfg.Source) ([]string, error) {
+	pattern, err := remotePath(u)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer client.Close()
 
-	var bytesContent bytes.Buffer
-	bytesWriter := bufio.NewWriter(&bytesContent)
+	conn, err := Dial(u, src)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 
-	// open source file
-	log.Debugf("opening file: %q", fileName)
-	srcFile, err := client.Open(fileName)
+	client, err := conn.Sftp()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// copy source file to destination file
-	bRead, err := io.Copy(bytesWriter, srcFile)
+	if !strings.HasSuffix(pattern, "/") {
+		log.Debugf("matching: %q on %s", pattern, conn.Host)
+		matches, err := client.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("unable to match %q on %s: %v", pattern, conn.Host, err)
+		}
+		return matches, nil
+	}
+
+	log.Debugf("listing: %q on %s", pattern, conn.Host)
+	files, err := client.ReadDir(pattern)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("unable to list %q on %s: %v", pattern, conn.Host, err)
+	}
+	matches := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+			matches = append(matches, path.Join(pattern, f.Name()))
+		}
 	}
-	bytesWriter.Flush()
-	log.Infof("%d bytes copied\n", bRead)
-	return bytesContent.Bytes(), host, port, nil
+	return matches, nil
 }
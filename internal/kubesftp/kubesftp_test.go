@@ -0,0 +1,1101 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/sftp"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeSudo behaves like sudo with the password from $FAKE_SUDO_PASSWORD
+const fakeSudo = `#!/bin/sh
+if [ "$1" = "-n" ]; then
+	shift
+	if [ -n "$FAKE_SUDO_PASSWORD" ]; then
+		echo "sudo: a password is required" >&2
+		exit 1
+	fi
+	exec "$@"
+fi
+if [ "$1" = "-S" ]; then
+	shift 3
+	read password
+	if [ "$password" != "$FAKE_SUDO_PASSWORD" ]; then
+		echo "Sorry, try again." >&2
+		exit 1
+	fi
+	exec "$@"
+fi
+exec "$@"
+`
+
+// testServer is a minimal ssh server: public key auth, the sftp subsystem, exec through the local shell
+// and direct-tcpip (for jump hosts).
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	// the server also has an ed25519 host key, x/crypto/ssh prefers the ecdsa one
+	ed25519HostKey ssh.PublicKey
+	env            []string
+	// files that can not be read over sftp
+	denied map[string]bool
+	// reject the sftp subsystem
+	noSftp bool
+	// accept this password, with the password auth method or keyboard-interactive when interactive is set
+	password    string
+	interactive bool
+	// connections accepted
+	connections int32
+}
+
+type testHandler struct {
+	s *testServer
+}
+
+func (h testHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if h.s.denied[r.Filepath] {
+		return nil, syscall.EACCES
+	}
+	return os.Open(r.Filepath)
+}
+
+func (h testHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h testHandler) Filecmd(r *sftp.Request) error {
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+type listerat []os.FileInfo
+
+func (l listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	return copy(ls, l[offset:]), nil
+}
+
+func (h testHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		files, err := ioutil.ReadDir(r.Filepath)
+		return listerat(files), err
+	case "Stat", "Lstat":
+		info, err := os.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func newTestServer(t *testing.T, authorized ssh.PublicKey) *testServer {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binDir := t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(fakeSudo), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		t:      t,
+		env:    []string{"PATH=" + binDir + ":" + os.Getenv("PATH")},
+		denied: make(map[string]bool),
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.password != "" && !s.interactive && string(password) == s.password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password")
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if s.password == "" || !s.interactive {
+				return nil, fmt.Errorf("keyboard-interactive disabled")
+			}
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != s.password {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+	s.hostKey = hostSigner.PublicKey()
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Signer, err := ssh.NewSignerFromKey(ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.AddHostKey(ed25519Signer)
+	s.ed25519HostKey = ed25519Signer.PublicKey()
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *testServer) address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	atomic.AddInt32(&s.connections, 1)
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go s.session(newChannel)
+		case "direct-tcpip":
+			go s.directTcpip(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func (s *testServer) session(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for req := range requests {
+		switch {
+		case req.Type == "subsystem" && string(req.Payload[4:]) == "sftp" && !s.noSftp:
+			req.Reply(true, nil)
+			handler := testHandler{s: s}
+			server := sftp.NewRequestServer(channel, sftp.Handlers{
+				FileGet:  handler,
+				FilePut:  handler,
+				FileCmd:  handler,
+				FileList: handler,
+			})
+			server.Serve()
+			return
+		case req.Type == "exec":
+			req.Reply(true, nil)
+			s.exec(channel, string(req.Payload[4:]))
+			return
+		}
+		req.Reply(false, nil)
+	}
+}
+
+func (s *testServer) exec(channel ssh.Channel, command string) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+
+	// like sshd, don't wait for the client to close stdin once the command exited
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	status := 0
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		status = 127
+	}
+	exitStatus := make([]byte, 4)
+	binary.BigEndian.PutUint32(exitStatus, uint32(status))
+	channel.SendRequest("exit-status", false, exitStatus)
+}
+
+func (s *testServer) directTcpip(newChannel ssh.NewChannel) {
+	payload := newChannel.ExtraData()
+	hostLen := binary.BigEndian.Uint32(payload)
+	host := string(payload[4 : 4+hostLen])
+	port := binary.BigEndian.Uint32(payload[4+hostLen:])
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		io.Copy(target, channel)
+		target.Close()
+	}()
+	io.Copy(channel, target)
+	channel.Close()
+}
+
+// testSetup points home to a temporary directory and creates the client key.
+func testSetup(t *testing.T) ssh.PublicKey {
+	home := t.TempDir()
+	homedir.DisableCache = true
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	os.Setenv("SSH_AUTH_SOCK", "")
+	t.Cleanup(func() {
+		os.Setenv("HOME", oldHome)
+		viper.Set("identity", "")
+	})
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(home, "id_test")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("identity", keyPath)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey()
+}
+
+func testFile(t *testing.T, content string) string {
+	fileName := filepath.Join(t.TempDir(), "config")
+	err := ioutil.WriteFile(fileName, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestGetFile(t *testing.T) {
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	jump := newTestServer(t, public)
+	fileName := testFile(t, "kubeconfig content")
+
+	deniedFileName := testFile(t, "root only content")
+	target.denied[deniedFileName] = true
+
+	noSftp := newTestServer(t, public)
+	noSftp.noSftp = true
+
+	sudoPassword := newTestServer(t, public)
+	sudoPassword.env = append(sudoPassword.env, "FAKE_SUDO_PASSWORD=sekrit")
+	os.Setenv("KHG_TEST_SUDO_PASSWORD", "sekrit")
+	defer os.Unsetenv("KHG_TEST_SUDO_PASSWORD")
+
+	tests := []struct {
+		name    string
+		url     string
+		src     cfg.Source
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Direct",
+			url:  "ssh://tester@" + target.address() + fileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew},
+			want: "kubeconfig content",
+		},
+		{
+			name: "Jump",
+			url:  "ssh://tester@" + target.address() + fileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Jump: "tester@" + jump.address()},
+			want: "kubeconfig content",
+		},
+		{
+			name: "JumpChain",
+			url:  "ssh://tester@" + target.address() + fileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Jump: "tester@" + jump.address() + ",tester@" + jump.address()},
+			want: "kubeconfig content",
+		},
+		{
+			name: "SudoFallback",
+			url:  "ssh://tester@" + target.address() + deniedFileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew},
+			want: "root only content",
+		},
+		{
+			name: "SudoPassword",
+			url:  "ssh://tester@" + sudoPassword.address() + fileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Sudo: true, SudoPassword: &cfg.Secret{Env: "KHG_TEST_SUDO_PASSWORD"}},
+			want: "kubeconfig content",
+		},
+		{
+			name:    "SudoPasswordMissing",
+			url:     "ssh://tester@" + sudoPassword.address() + fileName,
+			src:     cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Sudo: true},
+			wantErr: true,
+		},
+		{
+			name: "NoSftp",
+			url:  "ssh://tester@" + noSftp.address() + fileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew},
+			want: "kubeconfig content",
+		},
+		{
+			name: "Cat",
+			url:  "ssh://tester@" + noSftp.address() + fileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Transports: []string{TransportCat}},
+			want: "kubeconfig content",
+		},
+		{
+			name: "ScpSudoPassword",
+			url:  "ssh://tester@" + sudoPassword.address() + fileName,
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Sudo: true, SudoPassword: &cfg.Secret{Env: "KHG_TEST_SUDO_PASSWORD"}, Transports: []string{TransportScp}},
+			want: "kubeconfig content",
+		},
+		{
+			name:    "NotExist",
+			url:     "ssh://tester@" + noSftp.address() + fileName + ".missing",
+			src:     cfg.Source{HostKeyPolicy: HostKeyAcceptNew},
+			wantErr: true,
+		},
+		{
+			name:    "UnknownTransport",
+			url:     "ssh://tester@" + target.address() + fileName,
+			src:     cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Transports: []string{"rsync"}},
+			wantErr: true,
+		},
+		{
+			name:    "StrictUnknownHost",
+			url:     "ssh://tester@" + newTestServer(t, public).address() + fileName,
+			src:     cfg.Source{HostKeyPolicy: HostKeyStrict},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, err := GetFile(u, tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("GetFile() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFile_SudoTransports(t *testing.T) {
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	fileName := testFile(t, "kubeconfig content")
+	deniedFileName := testFile(t, "root only content")
+	target.denied[deniedFileName] = true
+
+	tests := []struct {
+		name     string
+		fileName string
+		src      cfg.Source
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "PermissionDeniedOnlySftp",
+			fileName: deniedFileName,
+			src:      cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Transports: []string{TransportSftp}},
+			wantErr:  "sudo needs the scp or cat transport, the source only uses: sftp: sftp: ",
+		},
+		{
+			name:     "SudoOnlySftp",
+			fileName: fileName,
+			src:      cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Sudo: true, Transports: []string{TransportSftp}},
+			wantErr:  "sudo needs the scp or cat transport, the source only uses: sftp",
+		},
+		{
+			name:     "PermissionDeniedSftpCat",
+			fileName: deniedFileName,
+			src:      cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Transports: []string{TransportSftp, TransportCat}},
+			want:     "root only content",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse("ssh://tester@" + target.address() + tt.fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, err := GetFile(u, tt.src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetFile() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("GetFile() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCommandOutput(t *testing.T) {
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	sudoPassword := newTestServer(t, public)
+	sudoPassword.env = append(sudoPassword.env, "FAKE_SUDO_PASSWORD=sekrit")
+	os.Setenv("KHG_TEST_SUDO_PASSWORD", "sekrit")
+	defer os.Unsetenv("KHG_TEST_SUDO_PASSWORD")
+
+	tests := []struct {
+		name       string
+		url        string
+		src        cfg.Source
+		want       string
+		wantStatus int
+		wantErr    bool
+	}{
+		{
+			name: "Command",
+			url:  "ssh://tester@" + target.address(),
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Command: "echo kubeconfig content"},
+			want: "kubeconfig content\n",
+		},
+		{
+			name: "UrlParameter",
+			url:  "ssh+exec://tester@" + target.address() + "?cmd=printf+%27a+b%27",
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew},
+			want: "a b",
+		},
+		{
+			name: "Sudo",
+			url:  "ssh+exec://tester@" + sudoPassword.address(),
+			src:  cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Command: "echo one; echo two", Sudo: true, SudoPassword: &cfg.Secret{Env: "KHG_TEST_SUDO_PASSWORD"}},
+			want: "one\ntwo\n",
+		},
+		{
+			name:       "ExitStatus",
+			url:        "ssh+exec://tester@" + target.address(),
+			src:        cfg.Source{HostKeyPolicy: HostKeyAcceptNew, Command: "echo broken >&2; exit 3"},
+			wantStatus: 3,
+			wantErr:    true,
+		},
+		{
+			name:    "NoCommand",
+			url:     "ssh+exec://tester@" + target.address(),
+			src:     cfg.Source{HostKeyPolicy: HostKeyAcceptNew},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, err := GetCommandOutput(u, tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetCommandOutput() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantStatus != 0 {
+				var cmdErr *CommandError
+				if !errors.As(err, &cmdErr) || cmdErr.ExitStatus != tt.wantStatus || cmdErr.Stderr != "broken" {
+					t.Errorf("GetCommandOutput() error = %#v, want exit status %d with stderr", err, tt.wantStatus)
+				}
+			}
+			if string(got) != tt.want {
+				t.Errorf("GetCommandOutput() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlob(t *testing.T) {
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	dir := t.TempDir()
+	for _, f := range []string{"dev/kubeconfig", "prod/kubeconfig", "prod/.hidden", "config"} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.ToSlash(dir)
+
+	tests := []struct {
+		name    string
+		url     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Glob",
+			url:  "ssh://tester@" + target.address() + root + "/*/kubeconfig",
+			want: []string{root + "/dev/kubeconfig", root + "/prod/kubeconfig"},
+		},
+		{
+			name: "Directory",
+			url:  "ssh://tester@" + target.address() + root + "/prod/",
+			want: []string{root + "/prod/kubeconfig"},
+		},
+		{
+			name:    "MissingDirectory",
+			url:     "ssh://tester@" + target.address() + root + "/missing/",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Glob(u, cfg.Source{HostKeyPolicy: HostKeyAcceptNew})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Glob() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Glob() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceSshSettings(t *testing.T) {
+	public := testSetup(t)
+	viper.Set("identity", "")
+	target := newTestServer(t, public)
+	fileName := testFile(t, "kubeconfig content")
+	host, port, err := net.SplitHostPort(target.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		src     cfg.Source
+		wantErr bool
+	}{
+		{
+			name: "UserPortIdentity",
+			url:  "ssh://" + host + fileName,
+			src:  cfg.Source{User: "tester", Port: portNumber, IdentityFile: "~/id_test", HostKeyPolicy: HostKeyAcceptNew},
+		},
+		{
+			name: "UrlPortWins",
+			url:  "ssh://" + target.address() + fileName,
+			src:  cfg.Source{Port: 1, IdentityFile: "~/id_test", HostKeyPolicy: HostKeyAcceptNew},
+		},
+		{
+			name:    "NoIdentity",
+			url:     "ssh://" + host + fileName,
+			src:     cfg.Source{User: "tester", Port: portNumber, HostKeyPolicy: HostKeyAcceptNew},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, err := GetFile(u, tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != "kubeconfig content" {
+				t.Errorf("GetFile() got = %q", got)
+			}
+		})
+	}
+}
+
+func TestPasswordAuth(t *testing.T) {
+	public := testSetup(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := testFile(t, "kubeconfig content")
+
+	// the client key is not authorized on these
+	password := newTestServer(t, otherSigner.PublicKey())
+	password.password = "sekrit"
+	interactive := newTestServer(t, otherSigner.PublicKey())
+	interactive.password = "sekrit"
+	interactive.interactive = true
+
+	os.Setenv("KHG_TEST_SSH_PASSWORD", "sekrit")
+	defer os.Unsetenv("KHG_TEST_SSH_PASSWORD")
+	os.Setenv("KHG_TEST_WRONG_PASSWORD", "wrong")
+	defer os.Unsetenv("KHG_TEST_WRONG_PASSWORD")
+
+	tests := []struct {
+		name    string
+		url     string
+		src     cfg.Source
+		wantErr bool
+	}{
+		{
+			name: "Password",
+			url:  "ssh://tester@" + password.address() + fileName,
+			src:  cfg.Source{SshPassword: &cfg.Secret{Env: "KHG_TEST_SSH_PASSWORD"}, HostKeyPolicy: HostKeyAcceptNew},
+		},
+		{
+			name: "KeyboardInteractive",
+			url:  "ssh://tester@" + interactive.address() + fileName,
+			src:  cfg.Source{SshPassword: &cfg.Secret{Env: "KHG_TEST_SSH_PASSWORD"}, HostKeyPolicy: HostKeyAcceptNew},
+		},
+		{
+			name:    "WrongPassword",
+			url:     "ssh://other@" + password.address() + fileName,
+			src:     cfg.Source{SshPassword: &cfg.Secret{Env: "KHG_TEST_WRONG_PASSWORD"}, HostKeyPolicy: HostKeyAcceptNew},
+			wantErr: true,
+		},
+		{
+			name:    "NoPassword",
+			url:     "ssh://nobody@" + password.address() + fileName,
+			src:     cfg.Source{HostKeyPolicy: HostKeyAcceptNew},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, err := GetFile(u, tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != "kubeconfig content" {
+				t.Errorf("GetFile() got = %q", got)
+			}
+		})
+	}
+
+	t.Run("CopyId", func(t *testing.T) {
+		u, err := url.Parse("ssh://copier@" + password.address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := cfg.Source{SshPassword: &cfg.Secret{Env: "KHG_TEST_SSH_PASSWORD"}, HostKeyPolicy: HostKeyAcceptNew}
+		// twice, the key is only added once
+		for i := 0; i < 2; i++ {
+			err = CopyId(u, src)
+			if err != nil {
+				t.Fatalf("CopyId() error = %v", err)
+			}
+		}
+		home, err := homedir.Dir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorized, err := ioutil.ReadFile(filepath.Join(home, ".ssh", "authorized_keys"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := string(ssh.MarshalAuthorizedKey(public))
+		if string(authorized) != want {
+			t.Errorf("authorized_keys got = %q, want %q", authorized, want)
+		}
+	})
+}
+
+func TestPool(t *testing.T) {
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	fileName := testFile(t, "kubeconfig content")
+	u, err := url.Parse("ssh://tester@" + target.address() + fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := cfg.Source{HostKeyPolicy: HostKeyAcceptNew}
+
+	EnablePool()
+	defer ClosePool()
+	for i := 0; i < 3; i++ {
+		got, _, _, err := GetFile(u, src)
+		if err != nil || string(got) != "kubeconfig content" {
+			t.Fatalf("GetFile() got = %q, error = %v", got, err)
+		}
+	}
+	_, _, _, err = GetCommandOutput(u, cfg.Source{Command: "true", HostKeyPolicy: HostKeyAcceptNew})
+	if err != nil {
+		t.Fatalf("GetCommandOutput() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&target.connections); got != 1 {
+		t.Errorf("connections with the pool = %d, want 1", got)
+	}
+
+	// another user is another connection
+	other, err := url.Parse("ssh://other@" + target.address() + fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = GetFile(other, src)
+	if err != nil {
+		t.Fatalf("GetFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&target.connections); got != 2 {
+		t.Errorf("connections for two users = %d, want 2", got)
+	}
+
+	// so are other credentials or another host key policy
+	for _, other := range []cfg.Source{
+		{HostKeyPolicy: HostKeyAcceptNew, IdentityFile: "~/id_test"},
+		{HostKeyPolicy: HostKeyStrict},
+	} {
+		_, _, _, err = GetFile(u, other)
+		if err != nil {
+			t.Fatalf("GetFile() error = %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&target.connections); got != 4 {
+		t.Errorf("connections for other source settings = %d, want 4", got)
+	}
+
+	ClosePool()
+	for i := 0; i < 2; i++ {
+		_, _, _, err = GetFile(u, src)
+		if err != nil {
+			t.Fatalf("GetFile() error = %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&target.connections); got != 6 {
+		t.Errorf("connections without the pool = %d, want 6", got)
+	}
+}
+
+func TestExpandControlPath(t *testing.T) {
+	home, err := homedir.Dir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &endpoint{alias: "bastion", host: "bastion.example.com", port: "22", user: "ops"}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "~/.ssh/cm-%r@%h:%p", want: home + "/.ssh/cm-ops@bastion.example.com:22"},
+		{path: "/tmp/%n-%%", want: "/tmp/bastion-%"},
+		{path: "%d/.ssh/%C", want: home + "/.ssh/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got := expandControlPath(tt.path, e)
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("expandControlPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := expandControlPath("%C", e); len(got) != 40 {
+		t.Errorf("expandControlPath() %%C = %q, want a sha1", got)
+	}
+}
+
+func TestProxyCommandTimeout(t *testing.T) {
+	testSetup(t)
+	testSshConfig(t, "Host hang\n  ProxyCommand exec sleep 60\nHost fail\n  ProxyCommand exit 1\n")
+	defer func(timeout time.Duration) { connectTimeout = timeout }(connectTimeout)
+	connectTimeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		alias       string
+		wantTimeout bool
+	}{
+		{name: "Hanging", alias: "hang", wantTimeout: true},
+		{name: "Failing", alias: "fail"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse("ssh://tester@" + tt.alias + "/kubeconfig")
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			_, err = Dial(u, cfg.Source{HostKeyPolicy: HostKeyAcceptNew})
+			if err == nil {
+				t.Fatalf("Dial() error = nil")
+			}
+			if timedOut := strings.Contains(err.Error(), "no answer after"); timedOut != tt.wantTimeout {
+				t.Errorf("Dial() error = %v, want timeout %v", err, tt.wantTimeout)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Dial() took %v", elapsed)
+			}
+		})
+	}
+}
+
+// TestControlMaster reads files and runs commands through an OpenSSH master connected to the target.
+func TestControlMaster(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("no ssh binary")
+	}
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	fileName := testFile(t, "kubeconfig content")
+	host, port, err := net.SplitHostPort(target.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unix socket paths are short
+	dir, err := ioutil.TempDir("", "khg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, host)
+	testSshConfig(t, "Host *\n  ControlPath "+dir+"/%h\n")
+	viper.Set("controlmaster", true)
+	defer viper.Set("controlmaster", false)
+
+	master := exec.Command("ssh", "-F", "/dev/null", "-N", "-o", "ControlMaster=yes", "-S", socket,
+		"-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+		"-i", viper.GetString("identity"), "-p", port, "tester@"+host)
+	err = master.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		master.Process.Kill()
+		master.Wait()
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("master not started: %v", err)
+	}
+
+	u, err := url.Parse("ssh://tester@" + target.address() + fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no known_hosts entry: strict host key checking would fail a new login
+	src := cfg.Source{HostKeyPolicy: HostKeyStrict}
+
+	EnablePool()
+	defer ClosePool()
+	for _, transport := range []string{"sftp", "scp", "cat"} {
+		src.Transports = []string{transport}
+		got, gotHost, _, err := GetFile(u, src)
+		if err != nil || string(got) != "kubeconfig content" || gotHost != host {
+			t.Errorf("GetFile() %s got = %q, host = %q, error = %v", transport, got, gotHost, err)
+		}
+	}
+	_, _, _, err = GetCommandOutput(u, cfg.Source{Command: "exit 3", HostKeyPolicy: HostKeyStrict})
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitStatus != 3 {
+		t.Errorf("GetCommandOutput() error = %v, want exit status 3", err)
+	}
+	if got := atomic.LoadInt32(&target.connections); got != 1 {
+		t.Errorf("connections = %d, want 1, the master", got)
+	}
+}
+
+func TestProbeFile(t *testing.T) {
+	public := testSetup(t)
+	target := newTestServer(t, public)
+	k3s := testFile(t, "k3s content")
+	custom := testFile(t, "custom content")
+	defaultFile := testFile(t, "default content")
+	missing := k3s + ".missing"
+
+	oldDistributions := Distributions
+	defer func() {
+		Distributions = oldDistributions
+		viper.Set("probepaths", nil)
+		viper.Set("defaultsourcepath", "")
+	}()
+
+	tests := []struct {
+		name             string
+		probePaths       []map[string]string
+		defaultPath      string
+		distributions    []cfg.ProbePath
+		want             string
+		wantDistribution string
+		wantErr          bool
+	}{
+		{
+			name:             "Distribution",
+			want:             "k3s content",
+			wantDistribution: "k3s",
+		},
+		{
+			name:             "Configured",
+			probePaths:       []map[string]string{{"name": "custom", "path": custom}},
+			want:             "custom content",
+			wantDistribution: "custom",
+		},
+		{
+			name:             "ConfiguredMissing",
+			probePaths:       []map[string]string{{"path": missing}},
+			want:             "k3s content",
+			wantDistribution: "k3s",
+		},
+		{
+			name:             "DefaultSourcePath",
+			probePaths:       []map[string]string{{"name": "custom", "path": custom}},
+			defaultPath:      defaultFile,
+			want:             "default content",
+			wantDistribution: DistributionDefault,
+		},
+		{
+			name:          "NothingFound",
+			distributions: []cfg.ProbePath{{Name: "rke2", Path: missing}},
+			wantErr:       true,
+		},
+		{
+			name:       "ConfiguredNoPath",
+			probePaths: []map[string]string{{"name": "custom"}},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("probepaths", tt.probePaths)
+			viper.Set("defaultsourcepath", tt.defaultPath)
+			Distributions = []cfg.ProbePath{{Name: "rke2", Path: missing}, {Name: "k3s", Path: k3s}}
+			if tt.distributions != nil {
+				Distributions = tt.distributions
+			}
+			u, err := url.Parse("ssh://tester@" + target.address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _, distribution, err := ProbeFile(u, cfg.Source{HostKeyPolicy: HostKeyAcceptNew})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProbeFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want || distribution != tt.wantDistribution {
+				t.Errorf("ProbeFile() got = %q, %q, want %q, %q", got, distribution, tt.want, tt.wantDistribution)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, _, _, err = GetFile(u, cfg.Source{HostKeyPolicy: HostKeyAcceptNew})
+			if err != nil || string(got) != tt.want {
+				t.Errorf("GetFile() got = %q, error = %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
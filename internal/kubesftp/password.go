@@ -0,0 +1,138 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/secret"
+	"golang.org/x/crypto/ssh"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	// passwords are kept for the whole run so every host is asked only once
+	passwordsLock sync.Mutex
+	passwords     = make(map[string]string)
+)
+
+// passwordFor returns the password of the endpoint, from its secret or the terminal.
+func passwordFor(e *endpoint) (string, error) {
+	passwordsLock.Lock()
+	defer passwordsLock.Unlock()
+
+	if password, ok := passwords[e.String()]; ok {
+		return password, nil
+	}
+	password, err := secret.Get(e.password, fmt.Sprintf("%s's password: ", e))
+	if err != nil {
+		return "", fmt.Errorf("unable to get password for: %s: %v", e, err)
+	}
+	passwords[e.String()] = password
+	return password, nil
+}
+
+// answerQuestions answers keyboard-interactive questions: the password for password prompts, the terminal for the others.
+func answerQuestions(e *endpoint) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" {
+			log.Infof("%s: %s", e, instruction)
+		}
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			var err error
+			switch {
+			case strings.Contains(strings.ToLower(question), "password"):
+				answers[i], err = passwordFor(e)
+			case echos[i]:
+				answers[i], err = secret.Ask(question)
+			default:
+				answers[i], err = secret.Prompt(question)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return answers, nil
+	}
+}
+
+// passwordAuth returns the keyboard-interactive and password auth methods, in the order OpenSSH tries them.
+// The password is only asked for once the server offers one of them. Nothing is returned when there is neither
+// a password secret nor a terminal, or ssh_config disables them.
+func passwordAuth(e *endpoint) []ssh.AuthMethod {
+	if e.password == nil && !secret.CanPrompt() {
+		return nil
+	}
+	if strings.ToLower(sshConfigGet(e.alias, "BatchMode")) == "yes" && e.password == nil {
+		return nil
+	}
+
+	methods := make([]ssh.AuthMethod, 0, 2)
+	if strings.ToLower(sshConfigGet(e.alias, "KbdInteractiveAuthentication")) != "no" {
+		methods = append(methods, ssh.RetryableAuthMethod(ssh.KeyboardInteractive(answerQuestions(e)), 1))
+	}
+	if strings.ToLower(sshConfigGet(e.alias, "PasswordAuthentication")) != "no" {
+		methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+			return passwordFor(e)
+		}))
+	}
+	return methods
+}
+
+// copyIdCommand appends the public key read from stdin to authorized_keys unless it is already there.
+const copyIdCommand = `cd && umask 077 && mkdir -p .ssh && touch .ssh/authorized_keys && read -r key && ` +
+	`{ grep -qxF "$key" .ssh/authorized_keys || printf '%s\n' "$key" >> .ssh/authorized_keys; }`
+
+// publicKey returns the public key of the first identity file found, in authorized_keys format.
+func publicKey(e *endpoint) (ssh.PublicKey, string, error) {
+	files, _ := identityFiles(e.alias, e.user, e.identityFile)
+	for _, f := range files {
+		id, err := loadIdentity(f)
+		if err != nil || id.public == nil {
+			continue
+		}
+		return id.public, id.path, nil
+	}
+	return nil, "", fmt.Errorf("no public key found for identity files: %v", files)
+}
+
+// CopyId installs the public key of the identity used for the source in the authorized_keys of the remote user,
+// like ssh-copy-id. Used on first contact with hosts that only accept passwords.
+func CopyId(u *url.URL, src cfg.Source) error {
+	target := targetEndpoint(u, src)
+	key, keyPath, err := publicKey(target)
+	if err != nil {
+		return err
+	}
+
+	conn, err := Dial(u, src)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	_, err = runCommand(conn, copyIdCommand, strings.NewReader(authorizedKey+"\n"))
+	if err != nil {
+		return fmt.Errorf("unable to install public key on %s: %v", target, err)
+	}
+	log.Infof("installed public key %s (%s) on %s", ssh.FingerprintSHA256(key), keyPath, target)
+	return nil
+}
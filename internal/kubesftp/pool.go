@@ -0,0 +1,94 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// pool keeps the connections of one command run, so sources on the same host share one connection
+// (and one sftp session). Connections are keyed by user, host, port, the route to the host and the
+// identity file, password and host key policy of the source.
+var pool = struct {
+	sync.Mutex
+	enabled bool
+	entries map[string]*poolEntry
+}{entries: make(map[string]*poolEntry)}
+
+type poolEntry struct {
+	// held while connecting, the other sources of the host wait for the connection
+	sync.Mutex
+	client *Client
+}
+
+// EnablePool makes Dial reuse connections until ClosePool is called.
+func EnablePool() {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.enabled = true
+}
+
+// ClosePool closes all the pooled connections and stops pooling.
+func ClosePool() {
+	pool.Lock()
+	defer pool.Unlock()
+	for key, entry := range pool.entries {
+		entry.Lock()
+		if entry.client != nil {
+			log.Debugf("closing pooled connection: %s", key)
+			entry.client.close()
+		}
+		entry.Unlock()
+	}
+	pool.entries = make(map[string]*poolEntry)
+	pool.enabled = false
+}
+
+// pooled returns the pooled connection for the key, connecting with dial when there is none or it is broken.
+func pooled(key string, dial func() (*Client, error)) (*Client, error) {
+	pool.Lock()
+	if !pool.enabled {
+		pool.Unlock()
+		return dial()
+	}
+	entry, ok := pool.entries[key]
+	if !ok {
+		entry = &poolEntry{}
+		pool.entries[key] = entry
+	}
+	pool.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.client != nil {
+		if entry.client.alive() {
+			log.Debugf("reusing connection: %s", key)
+			return entry.client, nil
+		}
+		log.Debugf("pooled connection is broken, reconnecting: %s", key)
+		entry.client.close()
+		entry.client = nil
+	}
+
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	client.pooled = true
+	entry.client = client
+	return client, nil
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"net/url"
+	"strings"
+)
+
+// DistributionDefault is reported when the kube configuration was found at defaultsourcepath.
+const DistributionDefault = "default"
+
+// Distributions are the known locations of the admin kube configuration, probed in order when
+// the source url has no path. Paths not starting with "/" are relative to the user's home.
+var Distributions = []cfg.ProbePath{
+	{Name: "k3s", Path: "/etc/rancher/k3s/k3s.yaml"},
+	{Name: "rke2", Path: "/etc/rancher/rke2/rke2.yaml"},
+	{Name: "kubeadm", Path: "/etc/kubernetes/admin.conf"},
+	{Name: "microk8s", Path: "/var/snap/microk8s/current/credentials/client.config"},
+	{Name: "k0s", Path: "/var/lib/k0s/pki/admin.conf"},
+	{Name: "kubectl", Path: "~/.kube/config"},
+}
+
+// probePaths returns the paths to probe: defaultsourcepath, the configured probepaths and
+// then the known distributions.
+func probePaths() ([]cfg.ProbePath, error) {
+	paths := make([]cfg.ProbePath, 0)
+	if defaultPath := viper.GetString("defaultsourcepath"); defaultPath != "" {
+		paths = append(paths, cfg.ProbePath{Name: DistributionDefault, Path: defaultPath})
+	}
+	configured := make([]cfg.ProbePath, 0)
+	err := viper.UnmarshalKey("probepaths", &configured)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read probepaths: %v", err)
+	}
+	for _, p := range configured {
+		if p.Path == "" {
+			return nil, fmt.Errorf("probepaths entry %q has no path", p.Name)
+		}
+		if p.Name == "" {
+			p.Name = p.Path
+		}
+		paths = append(paths, p)
+	}
+	return append(paths, Distributions...), nil
+}
+
+// probeName returns the path as it should be used on the remote host, see remotePath.
+func probeName(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return p
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(p, "~/"), "./")
+}
+
+// ProbeFile reads the first readable kube configuration out of the probe paths, over a single
+// connection. It also returns the distribution the configuration belongs to.
+func ProbeFile(u *url.URL, src cfg.Source) (contents []byte, host string, port string, distribution string, err error) {
+	paths, err := probePaths()
+	if err != nil {
+		return nil, "", "", "", err
+	}
+
+	conn, err := Dial(u, src)
+	if err != nil {
+		return nil, "", "", "", err
+	}
+	defer conn.Close()
+
+	errs := make([]string, 0)
+	for _, p := range paths {
+		fileName := probeName(p.Path)
+		log.Debugf("probing %s for %q (%s)", conn.Host, fileName, p.Name)
+		contents, err = readFile(conn, fileName, src)
+		if err == nil {
+			log.Infof("detected %s on %s, kube configuration: %q", p.Name, conn.Host, fileName)
+			return contents, conn.Host, conn.Port, p.Name, nil
+		}
+		if !isNotExist(err) {
+			errs = append(errs, fmt.Sprintf("%s: %v", fileName, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, "", "", "", fmt.Errorf("no readable kube configuration found on %s: %s", conn.Host, strings.Join(errs, "; "))
+	}
+	return nil, "", "", "", fmt.Errorf("no kube configuration found on %s, probed: %s", conn.Host, probeList(paths))
+}
+
+func probeList(paths []cfg.ProbePath) string {
+	names := make([]string, 0, len(paths))
+	for _, p := range paths {
+		names = append(names, p.Path)
+	}
+	return strings.Join(names, ", ")
+}
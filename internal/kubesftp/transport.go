@@ -0,0 +1,272 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package kubesftp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/shell"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Transports used to read files from ssh sources.
+const (
+	TransportSftp = "sftp"
+	TransportScp  = "scp"
+	TransportCat  = "cat"
+)
+
+// DefaultTransports is the order in which transports are tried when the source does not set one.
+var DefaultTransports = []string{TransportSftp, TransportScp, TransportCat}
+
+type transport func(conn *Client, fileName string, src cfg.Source, sudo bool) ([]byte, error)
+
+var transports = map[string]transport{
+	TransportSftp: readSftp,
+	TransportScp:  readScp,
+	TransportCat:  readCat,
+}
+
+func isPermissionDenied(err error) bool {
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		// some servers only send a generic failure code
+		return statusErr.FxCode() == sftp.ErrSSHFxPermissionDenied ||
+			strings.Contains(strings.ToLower(statusErr.Error()), "permission denied")
+	}
+	var cmdErr *CommandError
+	return errors.As(err, &cmdErr) && strings.Contains(strings.ToLower(cmdErr.Stderr), "permission denied")
+}
+
+func isNotExist(err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	var cmdErr *CommandError
+	return errors.As(err, &cmdErr) && strings.Contains(cmdErr.Stderr, "No such file or directory")
+}
+
+// readFile tries the transports of the source in order. When access is denied the remaining
+// transports (or the same one, for exec based transports) are tried again with sudo.
+func readFile(conn *Client, fileName string, src cfg.Source) ([]byte, error) {
+	order := src.Transports
+	if len(order) == 0 {
+		order = DefaultTransports
+	}
+	for _, name := range order {
+		if _, ok := transports[name]; !ok {
+			return nil, fmt.Errorf("unknown transport: %q, valid transports: %v", name, DefaultTransports)
+		}
+	}
+
+	sudo := src.Sudo
+	// a transport was tried with sudo
+	triedSudo := false
+	errs := make([]string, 0)
+	for i := 0; i < len(order); i++ {
+		name := order[i]
+		if sudo && name == TransportSftp {
+			log.Debugf("skipping %s transport, sudo is needed", name)
+			continue
+		}
+
+		triedSudo = triedSudo || sudo
+		contents, err := transports[name](conn, fileName, src, sudo)
+		if err == nil {
+			log.Infof("read %q from %s using %s transport", fileName, conn.Host, name)
+			return contents, nil
+		}
+		if isNotExist(err) {
+			return nil, err
+		}
+		if !sudo && isPermissionDenied(err) {
+			log.Warnf("permission denied reading %q using %s transport, retrying with sudo", fileName, name)
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			sudo = true
+			if name != TransportSftp {
+				i--
+			}
+			continue
+		}
+		log.Warnf("unable to read %q using %s transport: %v", fileName, name, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+	}
+	if sudo && !triedSudo {
+		err := fmt.Errorf("sudo needs the %s or %s transport, the source only uses: %s", TransportScp, TransportCat, strings.Join(order, ", "))
+		if len(errs) > 0 {
+			err = fmt.Errorf("%v: %s", err, strings.Join(errs, "; "))
+		}
+		return nil, err
+	}
+	return nil, fmt.Errorf("all transports failed: %s", strings.Join(errs, "; "))
+}
+
+func readSftp(conn *Client, fileName string, src cfg.Source, sudo bool) ([]byte, error) {
+	client, err := conn.Sftp()
+	if err != nil {
+		return nil, err
+	}
+
+	var bytesContent bytes.Buffer
+	bytesWriter := bufio.NewWriter(&bytesContent)
+
+	// open source file
+	log.Debugf("opening file: %q", fileName)
+	srcFile, err := client.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+
+	// copy source file to destination file
+	_, err = io.Copy(bytesWriter, srcFile)
+	if err != nil {
+		return nil, err
+	}
+	bytesWriter.Flush()
+	return bytesContent.Bytes(), nil
+}
+
+func readCat(conn *Client, fileName string, src cfg.Source, sudo bool) ([]byte, error) {
+	command := "cat " + shell.Quote(fileName)
+	if !sudo {
+		return runCommand(conn, command, nil)
+	}
+	return withSudo(conn, src, func(prefix string, stdin []byte) ([]byte, error) {
+		return runCommand(conn, prefix+command, bytes.NewReader(stdin))
+	})
+}
+
+func readScp(conn *Client, fileName string, src cfg.Source, sudo bool) ([]byte, error) {
+	command := "scp -f " + shell.Quote(fileName)
+	if !sudo {
+		return scpReceive(conn, command, nil)
+	}
+	return withSudo(conn, src, func(prefix string, stdin []byte) ([]byte, error) {
+		return scpReceive(conn, prefix+command, stdin)
+	})
+}
+
+// scpReceive runs the source side of the scp protocol ("scp -f") and receives a single file.
+func scpReceive(conn *Client, command string, preamble []byte) ([]byte, error) {
+	session, err := conn.newSession(command)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// the pipes are set by StdinPipe and StdoutPipe
+	var stderr bytes.Buffer
+	session.setIO(nil, nil, &stderr)
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("running remote command: %q", command)
+	err = session.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start remote command: %q: %v", command, err)
+	}
+
+	// the remote side failed before speaking the protocol
+	failed := func(protocolErr error) error {
+		stdin.Close()
+		if err := commandError(command, session.Wait(), &stderr); err != nil {
+			return err
+		}
+		return fmt.Errorf("scp protocol error: %v", protocolErr)
+	}
+
+	if len(preamble) > 0 {
+		if _, err := stdin.Write(preamble); err != nil {
+			return nil, failed(err)
+		}
+	}
+	ack := []byte{0}
+	if _, err := stdin.Write(ack); err != nil {
+		return nil, failed(err)
+	}
+
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, failed(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return nil, failed(fmt.Errorf("empty response"))
+		}
+
+		switch line[0] {
+		case 1, 2:
+			stdin.Close()
+			session.Wait()
+			return nil, &CommandError{Command: command, ExitStatus: 1, Stderr: strings.TrimSpace(line[1:])}
+		case 'T':
+			// modification times, only sent with -p
+			if _, err := stdin.Write(ack); err != nil {
+				return nil, failed(err)
+			}
+		case 'C':
+			// C<mode> <size> <name>
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) != 3 {
+				return nil, failed(fmt.Errorf("unexpected file header: %q", line))
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, failed(fmt.Errorf("unexpected file size: %q", line))
+			}
+			if _, err := stdin.Write(ack); err != nil {
+				return nil, failed(err)
+			}
+			contents := make([]byte, size)
+			if _, err := io.ReadFull(reader, contents); err != nil {
+				return nil, failed(err)
+			}
+			status, err := reader.ReadByte()
+			if err != nil || status != 0 {
+				return nil, failed(fmt.Errorf("transfer did not complete"))
+			}
+			if _, err := stdin.Write(ack); err != nil {
+				return nil, failed(err)
+			}
+			stdin.Close()
+			if err := commandError(command, session.Wait(), &stderr); err != nil {
+				return nil, err
+			}
+			return contents, nil
+		case 'D':
+			return nil, failed(fmt.Errorf("source is a directory"))
+		default:
+			return nil, failed(fmt.Errorf("unexpected response: %q", line))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package secret
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"github.com/stefan-kiss/khg/internal/shell"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoTerminal = errors.New("no terminal available to prompt")
+	ErrNotSet     = errors.New("secret not configured")
+
+	// only one prompt at a time, sources can be fetched in parallel
+	promptLock sync.Mutex
+)
+
+// Resolve returns the value the secret points to, without the trailing newline.
+func Resolve(s *cfg.Secret) (string, error) {
+	if s == nil {
+		return "", ErrNotSet
+	}
+	switch {
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable not set: %q", s.Env)
+		}
+		return value, nil
+	case s.File != "":
+		fileName := s.File
+		if strings.HasPrefix(fileName, "~/") {
+			home, err := homedir.Dir()
+			if err != nil {
+				return "", fmt.Errorf("unable to determine home for filename: %v :%v", fileName, err)
+			}
+			fileName = filepath.Join(home, fileName[2:])
+		}
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case s.Command != "":
+		var stderr bytes.Buffer
+		cmd := shell.Command(s.Command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret command failed: %q: %v: %s", s.Command, err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return "", ErrNotSet
+}
+
+// CanPrompt reports whether Prompt is able to ask for a value.
+func CanPrompt() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// Prompt reads a value from the terminal without echoing it.
+func Prompt(prompt string) (string, error) {
+	promptLock.Lock()
+	defer promptLock.Unlock()
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", ErrNoTerminal
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	value, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("unable to read from terminal: %v", err)
+	}
+	return string(value), nil
+}
+
+// Ask reads a line from the terminal, echoing it.
+func Ask(prompt string) (string, error) {
+	promptLock.Lock()
+	defer promptLock.Unlock()
+
+	if !CanPrompt() {
+		return "", ErrNoTerminal
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("unable to read from terminal: %v", err)
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// Get resolves the secret if one is configured and prompts on the terminal otherwise.
+func Get(s *cfg.Secret, prompt string) (string, error) {
+	if s != nil {
+		return Resolve(s)
+	}
+	return Prompt(prompt)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package secret
+
+import (
+	"github.com/stefan-kiss/khg/internal/cfg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	err := ioutil.WriteFile(secretFile, []byte("from-file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KHG_TEST_SECRET", "from-env")
+	defer os.Unsetenv("KHG_TEST_SECRET")
+
+	tests := []struct {
+		name    string
+		s       *cfg.Secret
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Env",
+			s:    &cfg.Secret{Env: "KHG_TEST_SECRET"},
+			want: "from-env",
+		},
+		{
+			name:    "EnvMissing",
+			s:       &cfg.Secret{Env: "KHG_TEST_SECRET_MISSING"},
+			wantErr: true,
+		},
+		{
+			name: "File",
+			s:    &cfg.Secret{File: secretFile},
+			want: "from-file",
+		},
+		{
+			name:    "FileMissing",
+			s:       &cfg.Secret{File: filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+		{
+			name: "Command",
+			s:    &cfg.Secret{Command: "echo from-command"},
+			want: "from-command",
+		},
+		{
+			name:    "NotSet",
+			s:       nil,
+			wantErr: true,
+		},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct {
+			name    string
+			s       *cfg.Secret
+			want    string
+			wantErr bool
+		}{
+			name:    "CommandFails",
+			s:       &cfg.Secret{Command: "exit 3"},
+			wantErr: true,
+		})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Resolve(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Resolve() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
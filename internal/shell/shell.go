@@ -0,0 +1,85 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Command returns a command that runs the command line through the system shell.
+func Command(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// Output runs the command line in dir, with env (NAME=value) added to the current environment, and returns its standard output.
+// The command is killed once the timeout expires. A zero timeout means no timeout.
+func Output(command string, dir string, env []string, timeout time.Duration) ([]byte, error) {
+	cmd := Command(command)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		for _, variable := range env {
+			if !strings.Contains(variable, "=") {
+				return nil, fmt.Errorf("environment variable is not in NAME=value form: %q", variable)
+			}
+		}
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start command %q: %v", command, err)
+	}
+
+	// children of the shell can keep the output open after it is killed, so don't wait for them
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case err = <-done:
+	case <-expired:
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("command %q timed out after %v", command, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("command %q failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Quote quotes a value for a POSIX shell. Remote hosts are expected to have one.
+func Quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
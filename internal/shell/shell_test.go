@@ -0,0 +1,81 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package shell
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutput(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		command string
+		dir     string
+		env     []string
+		timeout time.Duration
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Output",
+			command: "echo kubeconfig",
+			want:    "kubeconfig\n",
+		},
+		{
+			name:    "Env",
+			command: "printf %s \"$KHG_TEST_VALUE\"",
+			env:     []string{"KHG_TEST_VALUE=from env"},
+			want:    "from env",
+		},
+		{
+			name:    "BadEnv",
+			command: "true",
+			env:     []string{"KHG_TEST_VALUE"},
+			wantErr: true,
+		},
+		{
+			name:    "Dir",
+			command: "pwd",
+			dir:     dir,
+			want:    dir + "\n",
+		},
+		{
+			name:    "Fails",
+			command: "echo broken >&2; exit 1",
+			wantErr: true,
+		},
+		{
+			name:    "Timeout",
+			command: "sleep 5",
+			timeout: 100 * time.Millisecond,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Output(tt.command, tt.dir, tt.env, tt.timeout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Output() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("Output() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package tfstate reads outputs from local Terraform state files.
+package tfstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultOutput is the output read when none is given.
+const DefaultOutput = "kubeconfig"
+
+type output struct {
+	Value interface{} `json:"value"`
+}
+
+// state holds the outputs of version 4 state files (terraform 0.12 and later)
+// and the modules of version 3 ones, where the root module has the outputs.
+type state struct {
+	Version int               `json:"version"`
+	Outputs map[string]output `json:"outputs"`
+	Modules []struct {
+		Path    []string          `json:"path"`
+		Outputs map[string]output `json:"outputs"`
+	} `json:"modules"`
+}
+
+func (s *state) outputs() map[string]output {
+	if s.Version >= 4 {
+		return s.Outputs
+	}
+	for _, m := range s.Modules {
+		if len(m.Path) == 1 && m.Path[0] == "root" {
+			return m.Outputs
+		}
+	}
+	return nil
+}
+
+// splitPath splits a path into nested outputs: clusters.prod.kubeconfig or clusters[0].kubeconfig.
+func splitPath(path string) []string {
+	path = strings.ReplaceAll(path, "[", ".")
+	path = strings.ReplaceAll(path, "]", "")
+	parts := make([]string, 0)
+	for _, part := range strings.Split(path, ".") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// lookup follows the path into maps and lists.
+func lookup(value interface{}, path []string) (interface{}, error) {
+	for i, part := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[part]
+			if !ok {
+				return nil, fmt.Errorf("%q not found, keys: %v", strings.Join(path[:i+1], "."), keys(v))
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, fmt.Errorf("%q: invalid index for a list of %d", strings.Join(path[:i+1], "."), len(v))
+			}
+			value = v[index]
+		default:
+			return nil, fmt.Errorf("%q: not a map or list", strings.Join(path[:i], "."))
+		}
+	}
+	return value, nil
+}
+
+func keys(m map[string]interface{}) []string {
+	k := make([]string, 0, len(m))
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return k
+}
+
+// Parse returns the value of the output from the state. The output can be followed by a path into nested values:
+// clusters.prod.kubeconfig or clusters[0].kubeconfig. Strings are returned as they are, other values as json.
+func Parse(contents []byte, outputPath string) ([]byte, error) {
+	path := splitPath(outputPath)
+	if len(path) == 0 {
+		path = []string{DefaultOutput}
+	}
+	var s state
+	err := json.Unmarshal(contents, &s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse state: %v", err)
+	}
+	outputs := s.outputs()
+	out, ok := outputs[path[0]]
+	if !ok {
+		names := make([]string, 0, len(outputs))
+		for n := range outputs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("output %q not found in state, outputs: %v", path[0], names)
+	}
+
+	value, err := lookup(out.Value, path[1:])
+	if err != nil {
+		return nil, fmt.Errorf("output %q: %v", path[0], err)
+	}
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, fmt.Errorf("output %q is null", outputPath)
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// GetOutput reads the output from a local state file, see Parse.
+func GetOutput(stateFile string, outputPath string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state: %v", err)
+	}
+	return Parse(contents, outputPath)
+}
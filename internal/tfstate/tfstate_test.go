@@ -0,0 +1,79 @@
+// Copyright (c) 2021. Stefan Kiss
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package tfstate
+
+import (
+	"testing"
+)
+
+const testState = `{
+  "version": 4,
+  "outputs": {
+    "kubeconfig": {"value": "apiVersion: v1", "type": "string", "sensitive": true},
+    "clusters": {
+      "value": {
+        "prod": {"kube_admin_config_raw": "prod config"},
+        "list": [{"raw": "first"}, {"raw": "second"}]
+      },
+      "type": "object"
+    },
+    "structured": {"value": {"apiVersion": "v1", "kind": "Config"}, "type": "object"},
+    "empty": {"value": null, "type": "string"}
+  }
+}`
+
+const testStateV3 = `{
+  "version": 3,
+  "modules": [
+    {"path": ["root", "eks"], "outputs": {"kubeconfig": {"value": "module config"}}},
+    {"path": ["root"], "outputs": {"kubeconfig": {"value": "root config"}}}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{name: "Default", state: testState, output: "", want: "apiVersion: v1"},
+		{name: "Output", state: testState, output: "kubeconfig", want: "apiVersion: v1"},
+		{name: "Nested", state: testState, output: "clusters.prod.kube_admin_config_raw", want: "prod config"},
+		{name: "Index", state: testState, output: "clusters.list[1].raw", want: "second"},
+		{name: "IndexDots", state: testState, output: "clusters.list.0.raw", want: "first"},
+		{name: "Object", state: testState, output: "structured", want: `{"apiVersion":"v1","kind":"Config"}`},
+		{name: "V3", state: testStateV3, output: "kubeconfig", want: "root config"},
+		{name: "MissingOutput", state: testState, output: "kube_config", wantErr: true},
+		{name: "MissingKey", state: testState, output: "clusters.dev.kube_admin_config_raw", wantErr: true},
+		{name: "BadIndex", state: testState, output: "clusters.list[2].raw", wantErr: true},
+		{name: "NotAMap", state: testState, output: "kubeconfig.raw", wantErr: true},
+		{name: "Null", state: testState, output: "empty", wantErr: true},
+		{name: "NotJson", state: "apiVersion: v1", output: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.state), tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Parse() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}